@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+
+	"github.com/prometheus/prometheus/model/relabel"
+)
+
+// AggFunc is applied to values of series which became the same after relabeling
+type AggFunc uint8
+
+const (
+	AggSum AggFunc = iota
+	AggMax
+	AggMin
+	AggAvg
+	AggCount
+	AggFirst
+	AggLast
+)
+
+var aggFuncs = map[string]AggFunc{
+	"sum":   AggSum,
+	"max":   AggMax,
+	"min":   AggMin,
+	"avg":   AggAvg,
+	"count": AggCount,
+	"first": AggFirst,
+	"last":  AggLast,
+}
+
+// defaultAggs by metric TYPE, the rest are summed
+var defaultAggs = map[string]AggFunc{
+	"gauge":    AggMax,
+	"info":     AggMax,
+	"stateset": AggMax,
+}
+
+func (f AggFunc) String() string {
+	for k, v := range aggFuncs {
+		if v == f {
+			return k
+		}
+	}
+	return fmt.Sprintf("AggFunc(%d)", f)
+}
+
+func (f *AggFunc) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	v, ok := aggFuncs[strings.ToLower(s)]
+	if !ok {
+		return fmt.Errorf("unknown aggregation function %q", s)
+	}
+	*f = v
+	return nil
+}
+
+// AggregationConfig selects metrics by name and/or TYPE to use the aggregation function for, first match wins
+type AggregationConfig struct {
+	Regex    relabel.Regexp `yaml:"regex,omitempty"`
+	Type     string         `yaml:"type,omitempty"`
+	Function AggFunc        `yaml:"function,omitempty"` // sum by default
+}
+
+// aggFunc returns the function to aggregate series of the metric from aggregation_configs, or default by its TYPE
+func (p *Proxy) aggFunc(metricName string, m *Meta) AggFunc {
+	typ := ""
+	if m != nil {
+		typ = m.Type
+	}
+	for _, c := range p.Opts.Aggregation {
+		if c.Type != "" && c.Type != typ {
+			continue
+		}
+		if c.Regex.Regexp != nil && !c.Regex.MatchString(metricName) {
+			continue
+		}
+		return c.Function
+	}
+	if (typ == "counter" || typ == "histogram" || typ == "summary") && strings.HasSuffix(metricName, "_created") {
+		return AggMin // the earliest creation time
+	}
+	return defaultAggs[typ]
+}
+
+// ordered is true when aggregation_configs use `first` or `last`, which depend on the order upstreams are merged in
+func (p *Proxy) ordered() bool {
+	return slices.ContainsFunc(p.Opts.Aggregation, func(c *AggregationConfig) bool {
+		return c.Function == AggFirst || c.Function == AggLast
+	})
+}
+
+// merge aggregates value `x` (which could be already aggregated from x.n values) into `v`
+func (v *SVal) merge(x SVal, fn AggFunc) {
+	v.n += x.n
+	switch fn {
+	case AggSum:
+		v.Value += x.Value
+	case AggMax:
+		if x.Value > v.Value || math.IsNaN(v.Value) {
+			v.Value, v.TimestampMs = x.Value, x.TimestampMs
+		}
+	case AggMin:
+		if x.Value < v.Value || math.IsNaN(v.Value) {
+			v.Value, v.TimestampMs = x.Value, x.TimestampMs
+		}
+	case AggAvg:
+		v.Value += (x.Value - v.Value) * float64(x.n) / float64(v.n)
+	case AggCount:
+		v.Value += x.Value
+	case AggLast:
+		v.Value, v.TimestampMs = x.Value, x.TimestampMs
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/regexp"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/prometheus/model/relabel"
+	"gopkg.in/yaml.v2"
+)
+
+func TestAggregation(t *testing.T) {
+	var cfg Config
+	err := yaml.Unmarshal([]byte(`
+aggregation_configs:
+- regex: .*_last_reload_success
+  function: min
+- regex: metric_avg
+  function: avg
+- type: counter
+  regex: metric_count
+  function: count
+- regex: metric_last
+  function: last
+metric_relabel_configs:
+- action: labeldrop
+  regex: pod
+sub: []
+`), &cfg)
+	if err != nil {
+		t.Fatalf("yaml.Unmarshal() error = %v", err)
+	}
+	if len(cfg.Aggregation) != 4 || len(cfg.Relabel) != 2 || cfg.Relabel["sub"] == nil {
+		t.Fatalf("unexpected config: %+v", cfg)
+	}
+
+	cases := []struct {
+		input string
+		want  string
+	}{
+		{
+			input: m(
+				`# TYPE process_resident_memory_bytes gauge`,
+				`process_resident_memory_bytes{pod="a"} 10`,
+				`process_resident_memory_bytes{pod="b"} 30`,
+				`process_resident_memory_bytes{pod="c"} 20`,
+			),
+			want: `process_resident_memory_bytes 30`,
+		},
+		{
+			input: m(
+				`# TYPE nginx_last_reload_success gauge`,
+				`nginx_last_reload_success{pod="a"} 1`,
+				`nginx_last_reload_success{pod="b"} 0`,
+			),
+			want: `nginx_last_reload_success 0`,
+		},
+		{
+			input: m(
+				`metric_avg{pod="a"} 1`,
+				`metric_avg{pod="b"} 2`,
+				`metric_avg{pod="c"} 6`,
+			),
+			want: `metric_avg 3`,
+		},
+		{
+			input: m(
+				`# TYPE metric_count counter`,
+				`metric_count{pod="a"} 5`,
+				`metric_count{pod="b"} 5`,
+			),
+			want: `metric_count 2`,
+		},
+		{
+			input: m(
+				`metric_last{pod="a"} 5`,
+				`metric_last{pod="b"} 7 1751041454000`,
+			),
+			want: `metric_last 7 1751041454000`,
+		},
+		{
+			input: m(
+				`# TYPE metric_sum counter`,
+				`metric_sum{pod="a"} 5`,
+				`metric_sum{pod="b"} 7`,
+			),
+			want: `metric_sum 12`,
+		},
+	}
+	proxy := NewProxy(&Options{Relabel: cfg.Relabel, Aggregation: cfg.Aggregation}, &slog.Logger{})
+	for _, c := range cases {
+		subsets := map[string]*Series{default_subset: NewSeries(), "sub": NewSeries()}
+		if _, err := proxy.parse(context.Background(), strings.NewReader(c.input), expfmt.TypeTextPlain, nil, subsets); err != nil {
+			t.Errorf("parse(%s) error = %v", c.input, err)
+		}
+		var b strings.Builder
+		render(subsets[default_subset], 0, expfmt.TypeTextPlain, &b)
+		lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+		if res := lines[len(lines)-1]; res != c.want {
+			t.Errorf("got: '%s', want '%s'", res, c.want)
+		}
+	}
+}
+
+func TestAggregationOrder(t *testing.T) {
+	var upstreams []*UpstreamConfig
+	for i, delay := range []time.Duration{50 * time.Millisecond, 0, 0} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(delay) // the first upstream responds last
+			fmt.Fprintf(w, "version{pod=\"%d\"} %d\n", i, i+1)
+		}))
+		defer srv.Close()
+		u := &UpstreamConfig{URL: srv.URL}
+		if err := u.init(); err != nil {
+			t.Fatal(err)
+		}
+		upstreams = append(upstreams, u)
+	}
+	for fn, want := range map[AggFunc]string{AggFirst: "version 1", AggLast: "version 3"} {
+		proxy := NewProxy(&Options{
+			Upstreams:   upstreams,
+			Timeout:     time.Second,
+			Aggregation: []*AggregationConfig{{Function: fn}},
+			Relabel: map[string][]*relabel.Config{
+				default_subset: {{
+					Action: relabel.LabelDrop,
+					Regex:  relabel.Regexp{Regexp: regexp.MustCompile("pod")},
+				}},
+			},
+		}, slog.New(slog.DiscardHandler))
+		w := httptest.NewRecorder()
+		proxy.agg(w, httptest.NewRequest("GET", "/metrics", nil))
+		if lines := strings.Split(w.Body.String(), "\n"); !slices.Contains(lines, want) {
+			t.Errorf("%s: missing '%s' in:\n%s", fn, want, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/relabel"
+)
+
+// BucketConfig selects histogram `_bucket` metrics by name to keep only some of `le` buckets, first match wins.
+// As buckets are cumulative, the kept ones stay correct. `+Inf`, `_sum` and `_count` are always kept
+type BucketConfig struct {
+	Regex   relabel.Regexp `yaml:"regex,omitempty"`
+	Buckets []float64      `yaml:"buckets"`
+}
+
+// keepBucket returns false for `_bucket` sample of a histogram with `le` not listed in the matching bucket_configs rule
+func (p *Proxy) keepBucket(metricName string, lbls labels.Labels, m *Meta) bool {
+	if len(p.Opts.Buckets) == 0 || m == nil || m.Type != "histogram" || !strings.HasSuffix(metricName, "_bucket") {
+		return true
+	}
+	for _, c := range p.Opts.Buckets {
+		if c.Regex.Regexp != nil && !c.Regex.MatchString(metricName) {
+			continue
+		}
+		le, err := strconv.ParseFloat(lbls.Get("le"), 64)
+		if err != nil || math.IsInf(le, +1) {
+			return true
+		}
+		return slices.Contains(c.Buckets, le)
+	}
+	return true
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/common/expfmt"
+)
+
+func TestBuckets(t *testing.T) {
+	cfg, err := parseRelabel([]byte(`
+bucket_configs:
+- regex: .*_seconds_bucket
+  buckets: [0.1, 1]
+metric_relabel_configs:
+- action: labeldrop
+  regex: pod
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	input := m(
+		`# TYPE request_duration_seconds histogram`,
+		`request_duration_seconds_bucket{pod="a",le="0.05"} 1`,
+		`request_duration_seconds_bucket{pod="a",le="0.1"} 2`,
+		`request_duration_seconds_bucket{pod="a",le="0.5"} 3`,
+		`request_duration_seconds_bucket{pod="a",le="1"} 4`,
+		`request_duration_seconds_bucket{pod="a",le="+Inf"} 5`,
+		`request_duration_seconds_sum{pod="a"} 2.5`,
+		`request_duration_seconds_count{pod="a"} 5`,
+		`# TYPE response_size_bytes histogram`,
+		`response_size_bytes_bucket{pod="a",le="100"} 1`,
+		`response_size_bytes_bucket{pod="a",le="+Inf"} 2`,
+		`# TYPE queue_wait_seconds_bucket gauge`,
+		`queue_wait_seconds_bucket{pod="a",le="0.5"} 3`,
+	)
+	want := m(
+		`# TYPE queue_wait_seconds_bucket gauge`,
+		`queue_wait_seconds_bucket{le="0.5"} 3`,
+		`# TYPE request_duration_seconds histogram`,
+		`request_duration_seconds_bucket{le="0.1"} 2`,
+		`request_duration_seconds_bucket{le="1.0"} 4`,
+		`request_duration_seconds_bucket{le="+Inf"} 5`,
+		`request_duration_seconds_count 5`,
+		`request_duration_seconds_sum 2.5`,
+		`# TYPE response_size_bytes histogram`,
+		`response_size_bytes_bucket{le="100.0"} 1`,
+		`response_size_bytes_bucket{le="+Inf"} 2`,
+	)
+	proxy := NewProxy(&Options{Relabel: cfg.relabel(), Buckets: cfg.Buckets}, slog.New(slog.DiscardHandler))
+	subsets := map[string]*Series{default_subset: NewSeries()}
+	if _, err := proxy.parse(context.Background(), strings.NewReader(input), expfmt.TypeTextPlain, nil, subsets); err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	render(subsets[default_subset], 0, expfmt.TypeTextPlain, &b)
+	if res := strings.TrimSpace(b.String()); res != want {
+		t.Errorf("got: '%s', want '%s'", res, want)
+	}
+
+	cfg, err = parseRelabel([]byte(`bucket_configs: [{regex: .*}]`))
+	if err != nil || cfg.validate() == nil {
+		t.Errorf("no error for bucket_configs without buckets: %v", err)
+	}
+}
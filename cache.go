@@ -0,0 +1,62 @@
+package main
+
+import (
+	"time"
+)
+
+// upstreamCache is the last successful scrape result of an upstream
+type upstreamCache struct {
+	subsets map[string]*Series
+	samples int
+	ts      time.Time
+}
+
+// scrapeCached scrapes target `t` to its own series, and merges them to subsets. When the scrape fails, the last
+// successful result of the upstream is merged instead, unless it is older than --upstream-max-staleness
+func (p *Proxy) scrapeCached(t *Target, subsets map[string]*Series) (n int, stale bool, err error) {
+	own := make(map[string]*Series, len(subsets))
+	for s := range subsets {
+		own[s] = NewSeries()
+	}
+	n, err = p.scrape(t, own)
+
+	p.cacheMu.Lock()
+	c := p.cache[t.Name]
+	switch {
+	case err == nil:
+		c = &upstreamCache{subsets: own, samples: n, ts: time.Now()}
+		p.cache[t.Name] = c
+	case c != nil && time.Since(c.ts) < p.Opts.MaxStaleness:
+		p.logger.Warn("Using the last successful result of upstream", "host", t.Name, "age", time.Since(c.ts).Round(time.Second))
+		upstreamFallbacks.WithLabelValues(t.Name).Inc()
+		n, stale = c.samples, true
+	default:
+		delete(p.cache, t.Name)
+		c = nil
+	}
+	p.cacheMu.Unlock()
+
+	if c != nil {
+		for s, series := range c.subsets {
+			if subsets[s] != nil {
+				subsets[s].Merge(series)
+			}
+		}
+	}
+	return n, stale, err
+}
+
+// pruneCache forgets the results of upstreams which are not in `hosts` anymore
+func (p *Proxy) pruneCache(hosts []string) {
+	alive := make(map[string]bool, len(hosts))
+	for _, h := range hosts {
+		alive[h] = true
+	}
+	p.cacheMu.Lock()
+	defer p.cacheMu.Unlock()
+	for host := range p.cache {
+		if !alive[host] {
+			delete(p.cache, host)
+		}
+	}
+}
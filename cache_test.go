@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/grafana/regexp"
+	"github.com/prometheus/prometheus/model/relabel"
+)
+
+func TestUpstreamCache(t *testing.T) {
+	var failing atomic.Bool
+	var upstreams []*UpstreamConfig
+	for _, pod := range []string{"a", "b"} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if pod == "b" && failing.Load() {
+				w.WriteHeader(http.StatusServiceUnavailable) // empty body parses fine
+				return
+			}
+			fmt.Fprintln(w, "# TYPE metric_total counter")
+			fmt.Fprintf(w, "metric_total{pod=%q} 5\n", pod)
+		}))
+		defer srv.Close()
+		u := &UpstreamConfig{URL: srv.URL}
+		if err := u.init(); err != nil {
+			t.Fatal(err)
+		}
+		upstreams = append(upstreams, u)
+	}
+	hostB := strings.TrimPrefix(upstreams[1].URL, "http://")
+	proxy := NewProxy(&Options{
+		Upstreams:    upstreams,
+		Timeout:      time.Second,
+		MaxStaleness: time.Minute,
+		Relabel: map[string][]*relabel.Config{
+			default_subset: {{
+				Action: relabel.LabelDrop,
+				Regex:  relabel.Regexp{Regexp: regexp.MustCompile("pod")},
+			}},
+		},
+	}, slog.New(slog.DiscardHandler))
+	check := func(want ...string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		proxy.agg(w, httptest.NewRequest("GET", "/metrics", nil))
+		lines := strings.Split(w.Body.String(), "\n")
+		for _, s := range want {
+			if !slices.Contains(lines, s) {
+				t.Errorf("missing '%s' in:\n%s", s, w.Body.String())
+			}
+		}
+	}
+	check(`metric_total 10`, `metric_gate_upstream_stale{upstream="`+hostB+`"} 0`)
+
+	// failed upstream is replaced by its last result
+	failing.Store(true)
+	check(`metric_total 10`, `metric_gate_upstream_up{upstream="`+hostB+`"} 0`, `metric_gate_upstream_stale{upstream="`+hostB+`"} 1`)
+
+	// and dropped when it is too old
+	proxy.cacheMu.Lock()
+	proxy.cache[hostB].ts = time.Now().Add(-time.Hour)
+	proxy.cacheMu.Unlock()
+	check(`metric_total 5`, `metric_gate_upstream_stale{upstream="`+hostB+`"} 0`)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// encodings supported for responses, by preference
+var encodings = []string{"zstd", "gzip"}
+
+// negotiateEncoding returns the preferred encoding accepted by the client, or "" for identity
+func negotiateEncoding(h http.Header) string {
+	accepted := make(map[string]bool)
+	for _, part := range strings.Split(h.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				continue
+			}
+		}
+		accepted[strings.ToLower(name)] = true
+	}
+	for _, e := range encodings {
+		if accepted[e] || accepted["*"] {
+			return e
+		}
+	}
+	return ""
+}
+
+// compressor keeps pools of gzip and zstd writers with the configured level
+type compressor struct {
+	gzip sync.Pool
+	zstd sync.Pool
+}
+
+// newCompressor returns compressor with `level` 1-9, or 0 for the default level of each encoding
+func newCompressor(level int) *compressor {
+	c := &compressor{}
+	c.gzip.New = func() any {
+		l := gzip.DefaultCompression
+		if level > 0 {
+			l = level
+		}
+		w, _ := gzip.NewWriterLevel(nil, l)
+		return w
+	}
+	c.zstd.New = func() any {
+		l := zstd.SpeedDefault
+		if level > 0 {
+			l = zstd.EncoderLevelFromZstd(level)
+		}
+		w, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(l), zstd.WithEncoderConcurrency(1), zstd.WithLowerEncoderMem(true))
+		return w
+	}
+	return c
+}
+
+// writer returns writer compressing to w with `encoding`, which should be closed to flush and return it to the pool
+func (c *compressor) writer(w io.Writer, encoding string) io.WriteCloser {
+	switch encoding {
+	case "gzip":
+		gw := c.gzip.Get().(*gzip.Writer)
+		gw.Reset(w)
+		return &pooled{WriteCloser: gw, put: func() { c.gzip.Put(gw) }}
+	case "zstd":
+		zw := c.zstd.Get().(*zstd.Encoder)
+		zw.Reset(w)
+		return &pooled{WriteCloser: zw, put: func() { c.zstd.Put(zw) }}
+	}
+	return nopCloser{w}
+}
+
+type pooled struct {
+	io.WriteCloser
+	put func()
+}
+
+func (p *pooled) Close() error {
+	err := p.WriteCloser.Close()
+	p.put()
+	return err
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
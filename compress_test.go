@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/prometheus/model/relabel"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	cases := map[string]string{
+		"":                     "",
+		"gzip":                 "gzip",
+		"gzip, deflate, br":    "gzip",
+		"gzip;q=0.5, zstd":     "zstd",
+		"zstd;q=0, gzip;q=0.1": "gzip",
+		"identity":             "",
+		"*":                    "zstd",
+	}
+	for header, want := range cases {
+		h := http.Header{}
+		h.Set("Accept-Encoding", header)
+		if got := negotiateEncoding(h); got != want {
+			t.Errorf("(%s) got %q, want %q", header, got, want)
+		}
+	}
+}
+
+func TestCompressedResponses(t *testing.T) {
+	body := "metric1 1\n"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept-Encoding") == "gzip" {
+			w.Header().Set("Content-Encoding", "gzip")
+			gw := gzip.NewWriter(w)
+			defer gw.Close()
+			fmt.Fprint(gw, body)
+			return
+		}
+		fmt.Fprint(w, body)
+	}))
+	defer srv.Close()
+	proxy := NewProxy(&Options{
+		Upstream:         srv.URL,
+		Upstreams:        []*UpstreamConfig{{URL: srv.URL}},
+		Relabel:          map[string][]*relabel.Config{default_subset: {}},
+		Timeout:          time.Second,
+		CompressionLevel: 1,
+	}, slog.New(slog.DiscardHandler))
+
+	decode := func(encoding string, data []byte) string {
+		t.Helper()
+		var r io.Reader = bytes.NewReader(data)
+		var err error
+		switch encoding {
+		case "gzip":
+			r, err = gzip.NewReader(r)
+		case "zstd":
+			var zr *zstd.Decoder
+			zr, err = zstd.NewReader(r)
+			r = zr
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(res)
+	}
+	for _, c := range []struct {
+		path, accept, want string
+	}{
+		{"/metrics", "gzip", "gzip"},
+		{"/metrics", "zstd, gzip", "zstd"},
+		{"/metrics", "", ""},
+		{"/source", "gzip", "gzip"}, // passthrough
+		{"/source", "zstd", "zstd"},
+		{"/source", "", ""},
+	} {
+		for i := 0; i < 2; i++ { // pooled writers are reused
+			req := httptest.NewRequest("GET", c.path, nil)
+			req.Header.Set("Accept-Encoding", c.accept)
+			w := httptest.NewRecorder()
+			if c.path == "/source" {
+				proxy.src(w, req)
+			} else {
+				proxy.agg(w, req)
+			}
+			if got := w.Header().Get("Content-Encoding"); got != c.want {
+				t.Errorf("(%s %s) got Content-Encoding %q, want %q", c.path, c.accept, got, c.want)
+			}
+			if got := decode(c.want, w.Body.Bytes()); !strings.Contains(got, "metric1 1") {
+				t.Errorf("(%s %s) got body %q", c.path, c.accept, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/common/config"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/relabel"
+	"gopkg.in/yaml.v2"
+)
+
+// FileConfig is the schema of --config.file
+type FileConfig struct {
+	Global        GlobalConfig                 `yaml:"global,omitempty"`
+	Upstreams     []*UpstreamConfig            `yaml:"upstreams,omitempty"`
+	UpstreamSD    SDConfig                     `yaml:"upstream_sd,omitempty"`
+	HTTPConfig    *config.HTTPClientConfig     `yaml:"upstream_http_config,omitempty"`
+	TargetRelabel []*relabel.Config            `yaml:"relabel_configs,omitempty"`
+	MetricRelabel []*relabel.Config            `yaml:"metric_relabel_configs,omitempty"`
+	Aggregation   []*AggregationConfig         `yaml:"aggregation_configs,omitempty"`
+	Buckets       []*BucketConfig              `yaml:"bucket_configs,omitempty"`
+	Subsets       map[string][]*relabel.Config `yaml:"subsets,omitempty"`
+}
+
+// GlobalConfig are the settings which could be also set by flags, flags take precedence
+type GlobalConfig struct {
+	Port                     int            `yaml:"port,omitempty"`
+	AdminPort                int            `yaml:"admin_port,omitempty"`
+	ScrapeTimeout            model.Duration `yaml:"scrape_timeout,omitempty"`
+	ScrapeInterval           model.Duration `yaml:"scrape_interval,omitempty"`
+	CoalesceWindow           model.Duration `yaml:"scrape_coalesce_window,omitempty"`
+	MaxStaleness             model.Duration `yaml:"upstream_max_staleness,omitempty"`
+	ServeStaleFor            model.Duration `yaml:"serve_stale_for,omitempty"`
+	CompressionLevel         int            `yaml:"compression_level,omitempty"`
+	CounterResetCompensation bool           `yaml:"counter_reset_compensation,omitempty"`
+	FamilyRelabel            bool           `yaml:"family_relabel,omitempty"`
+	WebConfigFile            string         `yaml:"web_config_file,omitempty"`
+	AdminWebConfigFile       string         `yaml:"admin_web_config_file,omitempty"`
+	ConfigWatch              model.Duration `yaml:"config_watch_interval,omitempty"`
+	LogLevel                 string         `yaml:"log_level,omitempty"`
+}
+
+// SDConfig is the file or http service discovery of upstreams
+type SDConfig struct {
+	File            string         `yaml:"file,omitempty"`
+	URL             string         `yaml:"url,omitempty"`
+	RefreshInterval model.Duration `yaml:"refresh_interval,omitempty"`
+}
+
+// flags returns values of the settings which are set, by flag name
+func (g *GlobalConfig) flags(sd SDConfig) map[string]string {
+	res := make(map[string]string)
+	set := func(name, value string, ok bool) {
+		if ok {
+			res[name] = value
+		}
+	}
+	set("port", strconv.Itoa(g.Port), g.Port != 0)
+	set("web.admin-port", strconv.Itoa(g.AdminPort), g.AdminPort != 0)
+	set("scrape-timeout", time.Duration(g.ScrapeTimeout).String(), g.ScrapeTimeout != 0)
+	set("scrape-interval", time.Duration(g.ScrapeInterval).String(), g.ScrapeInterval != 0)
+	set("scrape-coalesce-window", time.Duration(g.CoalesceWindow).String(), g.CoalesceWindow != 0)
+	set("upstream-max-staleness", time.Duration(g.MaxStaleness).String(), g.MaxStaleness != 0)
+	set("serve-stale-for", time.Duration(g.ServeStaleFor).String(), g.ServeStaleFor != 0)
+	set("compression-level", strconv.Itoa(g.CompressionLevel), g.CompressionLevel != 0)
+	set("counter-reset-compensation", "true", g.CounterResetCompensation)
+	set("family-relabel", "true", g.FamilyRelabel)
+	set("web.config.file", g.WebConfigFile, g.WebConfigFile != "")
+	set("web.admin-config.file", g.AdminWebConfigFile, g.AdminWebConfigFile != "")
+	set("config.watch-interval", time.Duration(g.ConfigWatch).String(), g.ConfigWatch != 0)
+	set("log-level", g.LogLevel, g.LogLevel != "")
+	set("upstream-sd-file", sd.File, sd.File != "")
+	set("upstream-sd-url", sd.URL, sd.URL != "")
+	set("upstream-sd-refresh", time.Duration(sd.RefreshInterval).String(), sd.RefreshInterval != 0)
+	return res
+}
+
+// relabel returns relabel rules by subset name, where the default subset is `metric_relabel_configs`
+func (c *FileConfig) relabel() map[string][]*relabel.Config {
+	res := map[string][]*relabel.Config{default_subset: c.MetricRelabel}
+	if res[default_subset] == nil {
+		res[default_subset] = []*relabel.Config{}
+	}
+	for s, rules := range c.Subsets {
+		res[s] = rules
+	}
+	return res
+}
+
+// Config is the legacy relabel yaml of --relabel and --relabel-file, where each key except the known ones is a subset name
+type Config struct {
+	Upstreams     []*UpstreamConfig            `yaml:"upstreams,omitempty"`
+	Aggregation   []*AggregationConfig         `yaml:"aggregation_configs,omitempty"`
+	Buckets       []*BucketConfig              `yaml:"bucket_configs,omitempty"`
+	TargetRelabel []*relabel.Config            `yaml:"relabel_configs,omitempty"`
+	HTTPConfig    *config.HTTPClientConfig     `yaml:"upstream_http_config,omitempty"`
+	Relabel       map[string][]*relabel.Config `yaml:",inline"`
+}
+
+// loadConfig parses --config.file, or legacy relabel config from contents `re` or file `reFile`, and validates it
+func loadConfig(re, reFile, configFile string) (*FileConfig, error) {
+	n := 0
+	for _, s := range []string{re, reFile, configFile} {
+		if s != "" {
+			n++
+		}
+	}
+	if n > 1 {
+		return nil, fmt.Errorf("only one of `config.file`, `relabel` and `relabel-file` could be specified")
+	}
+	var cfg *FileConfig
+	switch {
+	case configFile != "":
+		data, err := os.ReadFile(configFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading config.file: %w", err)
+		}
+		cfg = &FileConfig{}
+		if err = yaml.UnmarshalStrict(data, cfg); err != nil {
+			return nil, fmt.Errorf("error parsing config.file: %w", err)
+		}
+		cfg.HTTPConfig.SetDirectory(filepath.Dir(configFile))
+	case reFile != "":
+		data, err := os.ReadFile(reFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading relabel-file: %w", err)
+		}
+		if cfg, err = parseRelabel(data); err != nil {
+			return nil, fmt.Errorf("error parsing relabel-file: %w", err)
+		}
+		cfg.HTTPConfig.SetDirectory(filepath.Dir(reFile))
+	default:
+		var err error
+		if cfg, err = parseRelabel([]byte(re)); err != nil {
+			return nil, fmt.Errorf("error parsing relabel: %w", err)
+		}
+	}
+	return cfg, cfg.validate()
+}
+
+// parseRelabel converts legacy relabel yaml to FileConfig
+func parseRelabel(data []byte) (*FileConfig, error) {
+	var c Config
+	if err := yaml.Unmarshal(data, &c); err != nil {
+		return nil, err
+	}
+	if len(c.Relabel) > 0 && c.Relabel[default_subset] == nil {
+		return nil, fmt.Errorf("relabel config key `metric_relabel_configs` is not defined")
+	}
+	cfg := &FileConfig{
+		Upstreams:     c.Upstreams,
+		HTTPConfig:    c.HTTPConfig,
+		TargetRelabel: c.TargetRelabel,
+		MetricRelabel: c.Relabel[default_subset],
+		Aggregation:   c.Aggregation,
+		Buckets:       c.Buckets,
+		Subsets:       c.Relabel,
+	}
+	delete(cfg.Subsets, default_subset)
+	return cfg, nil
+}
+
+// validate checks relabel rules and subset names
+func (c *FileConfig) validate() error {
+	for s := range c.Subsets {
+		if s == default_subset || s == "" {
+			return fmt.Errorf("invalid subset name %q", s)
+		}
+	}
+	for s, rules := range c.relabel() {
+		for _, r := range rules {
+			if err := r.Validate(); err != nil {
+				return fmt.Errorf("error validating relabel config %s: %w", s, err)
+			}
+		}
+	}
+	for _, r := range c.TargetRelabel {
+		if err := r.Validate(); err != nil {
+			return fmt.Errorf("error validating relabel config relabel_configs: %w", err)
+		}
+	}
+	for i, c := range c.Buckets {
+		if len(c.Buckets) == 0 {
+			return fmt.Errorf("error validating bucket_configs[%d]: buckets are not defined", i)
+		}
+	}
+	return nil
+}
+
+// configPath returns --config.file or --relabel-file
+func (p *Proxy) configPath() string {
+	return cmp.Or(p.Opts.ConfigFile, p.Opts.RelabelFile)
+}
+
+// reload re-reads config file and swaps the rules when no /metrics request is in progress,
+// the old rules are kept on errors. The rest of the settings need restart to change
+func (p *Proxy) reload() error {
+	if p.Opts.ConfigFile == "" && p.Opts.RelabelFile == "" {
+		return nil
+	}
+	cfg, err := loadConfig("", p.Opts.RelabelFile, p.Opts.ConfigFile)
+	p.cfgMu.Lock()
+	defer p.cfgMu.Unlock()
+	if err != nil {
+		reloadSuccess.Set(0)
+		p.logger.Error("Error reloading config, keeping the previous one", "err", err)
+		return err
+	}
+	reloadSuccess.Set(1)
+	reloadTimestamp.SetToCurrentTime()
+	p.Opts.Relabel, p.Opts.Aggregation, p.Opts.TargetRelabel = cfg.relabel(), cfg.Aggregation, cfg.TargetRelabel
+	p.Opts.Buckets = cfg.Buckets
+	p.mu.Lock()
+	p.retired = nil // relabeled with the new rules
+	p.mu.Unlock()
+	p.logger.Info("Config reloaded", "file", p.configPath())
+	return nil
+}
+
+// reloadHandler reloads config on POST /-/reload
+func (p *Proxy) reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		http.Error(w, "Only POST or PUT requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := p.reload(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// watchConfig reloads config file when it is modified, checking every `interval`
+func (p *Proxy) watchConfig(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var modTime time.Time
+	if fi, err := os.Stat(p.configPath()); err == nil {
+		modTime = fi.ModTime()
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			fi, err := os.Stat(p.configPath())
+			if err != nil || fi.ModTime().Equal(modTime) {
+				continue
+			}
+			modTime = fi.ModTime()
+			p.reload()
+		}
+	}
+}
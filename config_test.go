@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestReload(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `metric1{pod="a"} 1`)
+		fmt.Fprintln(w, `metric2{pod="a"} 2`)
+	}))
+	defer srv.Close()
+	path := filepath.Join(t.TempDir(), "relabel.yml")
+	write := func(data string) {
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`
+metric_relabel_configs:
+- source_labels: [__name__]
+  regex: metric1
+  action: keep
+`)
+	cfg, err := loadConfig("", path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := NewProxy(&Options{
+		Upstreams:   []*UpstreamConfig{{URL: srv.URL}},
+		RelabelFile: path,
+		Relabel:     cfg.relabel(),
+		Timeout:     time.Second,
+	}, slog.New(slog.DiscardHandler))
+	scrape := func() string {
+		w := httptest.NewRecorder()
+		proxy.agg(w, httptest.NewRequest("GET", "/metrics", nil))
+		return w.Body.String()
+	}
+	check := func(body string, want ...string) {
+		t.Helper()
+		for _, s := range want {
+			if !strings.Contains(body, s) {
+				t.Errorf("missing %q in:\n%s", s, body)
+			}
+		}
+	}
+	check(scrape(), `metric1{pod="a"} 1`)
+	ts := testutil.ToFloat64(reloadTimestamp)
+
+	// invalid config keeps the old one
+	write(`metric_relabel_configs: [{action: unknown}]`)
+	rec := httptest.NewRecorder()
+	proxy.reloadHandler(rec, httptest.NewRequest("POST", "/-/reload", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("got %d for invalid config", rec.Code)
+	}
+	body := scrape()
+	check(body, `metric1{pod="a"} 1`)
+	if ok := testutil.ToFloat64(reloadSuccess); ok != 0 {
+		t.Errorf("got reload successful %v after invalid config", ok)
+	}
+	if strings.Contains(body, "metric_gate_config_last_reload") {
+		t.Errorf("unexpected self-metrics in upstream payload:\n%s", body)
+	}
+	if strings.Contains(body, "metric2") {
+		t.Errorf("unexpected metric2 with the old config:\n%s", body)
+	}
+
+	write(`
+metric_relabel_configs:
+- action: labeldrop
+  regex: pod
+sub:
+- source_labels: [__name__]
+  regex: metric2
+  action: keep
+`)
+	if err := proxy.reload(); err != nil {
+		t.Fatal(err)
+	}
+	check(scrape(), "metric1 1", "metric2 2")
+	if ok, now := testutil.ToFloat64(reloadSuccess), testutil.ToFloat64(reloadTimestamp); ok != 1 || now < ts {
+		t.Errorf("got reload successful %v at %v after valid config", ok, now)
+	}
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/metrics/sub", nil)
+	req.SetPathValue("subset", "sub")
+	proxy.agg(w, req)
+	check(w.Body.String(), `metric2{pod="a"} 2`)
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yml")
+	data := `
+global:
+  port: 9090
+  scrape_timeout: 5s
+  serve_stale_for: 1d
+upstreams:
+- url: dns+http://svc:8080/metrics
+upstream_sd:
+  file: targets.yml
+metric_relabel_configs:
+- action: labeldrop
+  regex: pod
+subsets:
+  sub:
+  - source_labels: [__name__]
+    regex: metric2
+    action: keep
+`
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfig("", "", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules := cfg.relabel()
+	if len(rules) != 2 || len(rules[default_subset]) != 1 || len(rules["sub"]) != 1 || len(cfg.Upstreams) != 1 {
+		t.Errorf("unexpected config %+v", cfg)
+	}
+	flags := cfg.Global.flags(cfg.UpstreamSD)
+	want := map[string]string{"port": "9090", "scrape-timeout": "5s", "serve-stale-for": "24h0m0s", "upstream-sd-file": "targets.yml"}
+	if len(flags) != len(want) {
+		t.Errorf("got flags %v, want %v", flags, want)
+	}
+	for k, v := range want {
+		if flags[k] != v {
+			t.Errorf("flag %s = %q, want %q", k, flags[k], v)
+		}
+	}
+
+	// unknown keys are errors, unlike in legacy relabel config where they are subsets
+	if err := os.WriteFile(path, []byte(data+"sub2: []\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadConfig("", "", path); err == nil {
+		t.Error("expected error for unknown key")
+	}
+	legacy, err := loadConfig("metric_relabel_configs: []\nsub2: []\n", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rules := legacy.relabel(); len(rules) != 2 || rules["sub2"] == nil {
+		t.Errorf("unexpected legacy subsets %v", rules)
+	}
+	if _, err := loadConfig("sub2: []\n", "", ""); err == nil {
+		t.Error("expected error for legacy config without metric_relabel_configs")
+	}
+	if _, err := loadConfig("metric_relabel_configs: []", "", path); err == nil {
+		t.Error("expected error for both relabel and config.file")
+	}
+}
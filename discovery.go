@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/relabel"
+)
+
+// Resolver is the part of net.Resolver used for discovery
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// UpstreamConfig is a source URL with optional labels to add to all its metrics
+type UpstreamConfig struct {
+	URL    string            `yaml:"url"`
+	Labels map[string]string `yaml:"labels,omitempty"`
+	// IncludeNotReady scrapes not ready endpoints too, for `k8s+` mode
+	IncludeNotReady bool `yaml:"include_not_ready,omitempty"`
+	// AddressType is the address family of EndpointSlices to use, IPv4 (default) or IPv6, for `k8s+` mode
+	AddressType string   `yaml:"address_type,omitempty"`
+	mode        string   // discovery prefix of the URL
+	resolve     *url.URL // set for URLs with discovery prefix
+	labels      labels.Labels
+}
+
+// discovery modes by URL prefix, as in thanos
+var sdModes = []string{"dns", "dnssrv", "dnssrvnoa", "k8s"}
+
+// init validates the config, adds default scheme to URL and strips discovery prefix
+func (u *UpstreamConfig) init() error {
+	if !strings.Contains(u.URL, "://") {
+		u.URL = "http://" + u.URL
+	}
+	for _, mode := range sdModes {
+		if strings.HasPrefix(u.URL, mode+"+") {
+			u.mode = mode
+			u.URL = u.URL[len(mode)+1:]
+		}
+	}
+	parts, err := url.Parse(u.URL)
+	if err != nil {
+		return fmt.Errorf("error parsing upstream %s as url: %w", u.URL, err)
+	}
+	if u.mode != "" {
+		u.resolve = parts
+	}
+	switch u.AddressType {
+	case "":
+		u.AddressType = "IPv4"
+	case "IPv4", "IPv6":
+	default:
+		return fmt.Errorf("invalid address_type %q for upstream %s, should be IPv4 or IPv6", u.AddressType, u.URL)
+	}
+	for k := range u.Labels {
+		if !model.LabelName(k).IsValid() || strings.HasPrefix(k, "__") {
+			return fmt.Errorf("invalid label name %q for upstream %s", k, u.URL)
+		}
+	}
+	u.labels = labels.FromMap(u.Labels)
+	return nil
+}
+
+// Target is a single endpoint to scrape
+type Target struct {
+	URL    string
+	Host   string        // Host header to preserve, when URL has IP
+	Name   string        // value of `upstream` label
+	Labels labels.Labels // added to samples, unless they already have such label
+	Meta   labels.Labels // `__meta_*` labels from discovery, only visible to relabeling
+	resets *resets       // set on the copy of target during scrape, when compensation is enabled
+}
+
+// fanout is true when metrics are aggregated from multiple targets
+func (p *Proxy) fanout() bool {
+	return len(p.Opts.Upstreams) > 1 || len(p.Opts.Discovery) > 0 || len(p.Opts.Upstreams) == 1 && p.Opts.Upstreams[0].resolve != nil
+}
+
+// upstream returns URL for /source and /analyze, which is the first configured or discovered one
+func (p *Proxy) upstream() string {
+	if p.Opts.Upstream != "" {
+		return p.Opts.Upstream
+	}
+	for _, d := range p.Opts.Discovery {
+		if ts := d.Targets(); len(ts) > 0 {
+			return ts[0].URL
+		}
+	}
+	return ""
+}
+
+// targets returns endpoints to scrape for all the upstreams, errors are only returned when there are no targets
+func (p *Proxy) targets() ([]*Target, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.Opts.Timeout)
+	defer cancel()
+	var res []*Target
+	var errs []error
+	for _, u := range p.Opts.Upstreams {
+		var ts []*Target
+		var err error
+		switch u.mode {
+		case "dns":
+			ts, err = p.lookupIP(ctx, u, u.resolve.Hostname(), u.resolve.Port())
+		case "dnssrv", "dnssrvnoa":
+			ts, err = p.lookupSRV(ctx, u)
+		default:
+			t := &Target{URL: u.URL, Name: u.URL, Labels: u.labels}
+			if parts, err := url.Parse(u.URL); err == nil {
+				t.Name = parts.Host
+			}
+			ts = []*Target{t}
+		}
+		if err != nil {
+			p.logger.Error("Error resolving upstream", "host", u.resolve.Host, "err", err)
+			errs = append(errs, err)
+			continue
+		}
+		res = append(res, byName(ts)...)
+	}
+	for _, d := range p.Opts.Discovery {
+		res = append(res, byName(d.Targets())...)
+	}
+	if len(res) == 0 && len(errs) > 0 {
+		return nil, errs[0]
+	}
+	if len(p.Opts.TargetRelabel) > 0 {
+		res = p.relabelTargets(res)
+	}
+	return uniqueNames(res), nil
+}
+
+// uniqueNames renames targets which share a name, like paths of the same host or ports of the same IP, to host and path
+// of their URLs, as counter resets, cache and self-metrics are kept by name
+func uniqueNames(ts []*Target) []*Target {
+	seen := make(map[string]int, len(ts))
+	for _, t := range ts {
+		seen[t.Name]++
+	}
+	for i, t := range ts {
+		if seen[t.Name] < 2 {
+			continue
+		}
+		if parts, err := url.Parse(t.URL); err == nil {
+			rt := *t // targets from discovery are shared
+			rt.Name = parts.Host + parts.RequestURI()
+			ts[i] = &rt
+		}
+	}
+	return ts
+}
+
+// byName returns a copy of targets sorted by name, for the same order of discovered targets between scrapes
+func byName(ts []*Target) []*Target {
+	ts = slices.Clone(ts)
+	slices.SortStableFunc(ts, func(a, b *Target) int { return strings.Compare(a.Name, b.Name) })
+	return ts
+}
+
+// relabelTargets applies relabel_configs to targets labels and `__address__`, `__scheme__`, `__metrics_path__`, `__meta_*`,
+// resulting labels not starting with `__` are added to samples
+func (p *Proxy) relabelTargets(targets []*Target) []*Target {
+	res := make([]*Target, 0, len(targets))
+	lb := labels.NewBuilder(labels.EmptyLabels())
+	for _, t := range targets {
+		parts, err := url.Parse(t.URL)
+		if err != nil {
+			continue
+		}
+		lb.Reset(t.Labels)
+		t.Meta.Range(func(l labels.Label) { lb.Set(l.Name, l.Value) })
+		lb.Set(model.AddressLabel, parts.Host)
+		lb.Set(model.SchemeLabel, parts.Scheme)
+		lb.Set(model.MetricsPathLabel, parts.Path)
+		if !relabel.ProcessBuilder(lb, p.Opts.TargetRelabel...) {
+			p.logger.Debug("Target dropped by relabel_configs", "upstream", t.Name)
+			continue
+		}
+		address := lb.Get(model.AddressLabel)
+		if address == "" {
+			p.logger.Error("Target has empty __address__ after relabel_configs", "upstream", t.Name)
+			continue
+		}
+		rt := *t // targets from discovery are shared
+		if address != parts.Host {
+			rt.Name = address // `upstream` label follows the address actually scraped
+		}
+		parts.Scheme, parts.Host, parts.Path = lb.Get(model.SchemeLabel), address, lb.Get(model.MetricsPathLabel)
+		rt.URL = parts.String()
+		lb.Range(func(l labels.Label) {
+			if strings.HasPrefix(l.Name, model.ReservedLabelPrefix) {
+				lb.Del(l.Name)
+			}
+		})
+		rt.Labels = lb.Labels()
+		res = append(res, &rt)
+	}
+	return res
+}
+
+// lookupIP returns targets for A/AAAA records of `host`, with URL from upstream `u`
+func (p *Proxy) lookupIP(ctx context.Context, u *UpstreamConfig, host, port string) ([]*Target, error) {
+	ips, err := p.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*Target, 0, len(ips))
+	for _, ip := range ips {
+		name := ip.IP.String()
+		if u.mode != "dns" {
+			name = net.JoinHostPort(name, port) // ports could differ
+		}
+		t := u.target(ip.IP.String(), port, host, name)
+		t.Meta = labels.FromStrings("__meta_dns_name", host, "__meta_upstream_ip", ip.IP.String())
+		res = append(res, t)
+	}
+	return res, nil
+}
+
+// lookupSRV returns targets for SRV records of upstream `u`, which are resolved to IPs unless mode is 'dnssrvnoa'
+func (p *Proxy) lookupSRV(ctx context.Context, u *UpstreamConfig) ([]*Target, error) {
+	_, srvs, err := p.resolver.LookupSRV(ctx, "", "", u.resolve.Hostname())
+	if err != nil {
+		return nil, err
+	}
+	var res []*Target
+	for _, srv := range srvs {
+		host := strings.TrimSuffix(srv.Target, ".")
+		port := strconv.Itoa(int(srv.Port))
+		meta := labels.NewBuilder(labels.FromStrings("__meta_dns_name", u.resolve.Hostname(), "__meta_dns_srv_record_target", host, "__meta_dns_srv_record_port", port))
+		if u.mode == "dnssrvnoa" {
+			t := u.target(host, port, "", net.JoinHostPort(host, port))
+			t.Meta = meta.Labels()
+			res = append(res, t)
+			continue
+		}
+		ts, err := p.lookupIP(ctx, u, host, port)
+		if err != nil {
+			p.logger.Error("Error resolving SRV target", "host", host, "err", err)
+			continue
+		}
+		for _, t := range ts {
+			meta.Set("__meta_upstream_ip", t.Meta.Get("__meta_upstream_ip"))
+			t.Meta = meta.Labels()
+		}
+		res = append(res, ts...)
+	}
+	return res, nil
+}
+
+// target returns Target for `host` and `port` with the rest of URL from upstream
+func (u *UpstreamConfig) target(host, port, hostHeader, name string) *Target {
+	t := *u.resolve
+	t.Host = host
+	if port != "" {
+		t.Host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		t.Host = "[" + host + "]" // IPv6
+	}
+	return &Target{URL: t.String(), Host: hostHeader, Name: name, Labels: u.labels}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/regexp"
+	"github.com/prometheus/prometheus/model/relabel"
+	"gopkg.in/yaml.v2"
+)
+
+func TestUpstreamConfig(t *testing.T) {
+	cases := []struct {
+		url     string
+		want    string
+		resolve bool
+		err     bool
+	}{
+		{url: "localhost:8080/metrics", want: "http://localhost:8080/metrics"},
+		{url: "dns+http://svc:8080/metrics", want: "http://svc:8080/metrics", resolve: true},
+		{url: "dns+svc:8080/metrics", want: "http://dns+svc:8080/metrics"},
+		{url: "dnssrv+http://_metrics._tcp.svc/metrics", want: "http://_metrics._tcp.svc/metrics", resolve: true},
+		{url: "dnssrvnoa+https://_metrics._tcp.svc/metrics", want: "https://_metrics._tcp.svc/metrics", resolve: true},
+		{url: "http://svc/metrics", err: true},
+	}
+	for _, c := range cases {
+		u := &UpstreamConfig{URL: c.url}
+		if c.err {
+			u.Labels = map[string]string{"__address__": "a"}
+		}
+		err := u.init()
+		if (err != nil) != c.err {
+			t.Errorf("(%s) unexpected error %v", c.url, err)
+			continue
+		}
+		if !c.err && (u.URL != c.want || (u.resolve != nil) != c.resolve) {
+			t.Errorf("(%s) got %s %v, want %s %v", c.url, u.URL, u.resolve != nil, c.want, c.resolve)
+		}
+	}
+}
+
+func TestStaticUpstreams(t *testing.T) {
+	var upstreams []*UpstreamConfig
+	for _, c := range []string{"a", "b"} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintln(w, "# TYPE metric_total counter")
+			fmt.Fprintln(w, `metric_total{pod="1"} 1`)
+			fmt.Fprintln(w, `metric_total{pod="2",cluster="c"} 2`)
+		}))
+		defer srv.Close()
+		u := &UpstreamConfig{URL: srv.URL, Labels: map[string]string{"cluster": c}}
+		if err := u.init(); err != nil {
+			t.Fatal(err)
+		}
+		upstreams = append(upstreams, u)
+	}
+	proxy := NewProxy(&Options{
+		Upstreams: upstreams,
+		Timeout:   time.Second,
+		Relabel: map[string][]*relabel.Config{
+			default_subset: {
+				{
+					Action: relabel.LabelDrop,
+					Regex:  relabel.Regexp{Regexp: regexp.MustCompile("pod")},
+				},
+			},
+		},
+	}, slog.New(slog.DiscardHandler))
+
+	w := httptest.NewRecorder()
+	proxy.agg(w, httptest.NewRequest("GET", "/metrics", nil))
+	lines := strings.Split(w.Body.String(), "\n")
+	for _, want := range []string{
+		`metric_total{cluster="a"} 1`,
+		`metric_total{cluster="b"} 1`,
+		`metric_total{cluster="c"} 4`,
+		`metric_gate_upstream_up{upstream="` + strings.TrimPrefix(upstreams[0].URL, "http://") + `"} 1`,
+	} {
+		if !slices.Contains(lines, want) {
+			t.Errorf("missing '%s' in '%s'", want, w.Body.String())
+		}
+	}
+}
+
+func TestUpstreamNames(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/bad" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintln(w, "metric 1")
+	}))
+	defer srv.Close()
+	var upstreams []*UpstreamConfig
+	for _, path := range []string{"/good", "/bad"} {
+		u := &UpstreamConfig{URL: srv.URL + path}
+		if err := u.init(); err != nil {
+			t.Fatal(err)
+		}
+		upstreams = append(upstreams, u)
+	}
+	proxy := NewProxy(&Options{
+		Upstreams: upstreams,
+		Timeout:   time.Second,
+		Relabel:   map[string][]*relabel.Config{default_subset: {}},
+	}, slog.New(slog.DiscardHandler))
+
+	w := httptest.NewRecorder()
+	proxy.agg(w, httptest.NewRequest("GET", "/metrics", nil))
+	lines := strings.Split(w.Body.String(), "\n")
+	host := strings.TrimPrefix(srv.URL, "http://")
+	for _, want := range []string{
+		`metric_gate_upstream_up{upstream="` + host + `/good"} 1`,
+		`metric_gate_upstream_up{upstream="` + host + `/bad"} 0`,
+	} {
+		if !slices.Contains(lines, want) {
+			t.Errorf("missing '%s' in '%s'", want, w.Body.String())
+		}
+	}
+
+	// ports of the same Service
+	upstreams = nil
+	for _, port := range []string{"8080", "9090"} {
+		u := &UpstreamConfig{URL: "dns+http://svc:" + port + "/metrics"}
+		if err := u.init(); err != nil {
+			t.Fatal(err)
+		}
+		upstreams = append(upstreams, u)
+	}
+	proxy = NewProxy(&Options{Upstreams: upstreams, Timeout: time.Second}, slog.New(slog.DiscardHandler))
+	proxy.resolver = &stubResolver{ips: map[string][]string{"svc": {"10.0.0.1"}}}
+	targets, err := proxy.targets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, t := range targets {
+		got = append(got, t.Name)
+	}
+	if want := []string{"10.0.0.1:8080/metrics", "10.0.0.1:9090/metrics"}; !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// stubResolver serves DNS records from maps
+type stubResolver struct {
+	ips  map[string][]string
+	srvs map[string][]*net.SRV
+}
+
+func (r *stubResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if r.ips[host] == nil {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	var res []net.IPAddr
+	for _, ip := range r.ips[host] {
+		res = append(res, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	return res, nil
+}
+
+func (r *stubResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	if r.srvs[name] == nil {
+		return "", nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return name, r.srvs[name], nil
+}
+
+func TestTargets(t *testing.T) {
+	resolver := &stubResolver{
+		ips: map[string][]string{
+			"svc":   {"10.0.0.1", "fd00::1"},
+			"pod-a": {"10.0.0.2"},
+			"pod-b": {"10.0.0.3"},
+		},
+		srvs: map[string][]*net.SRV{
+			"_metrics._tcp.svc": {
+				{Target: "pod-a.", Port: 9100},
+				{Target: "pod-b", Port: 9200},
+			},
+		},
+	}
+	cases := []struct {
+		upstream string
+		want     []string // Name URL Host
+		err      bool
+	}{
+		{
+			upstream: "http://svc:8080/metrics",
+			want:     []string{"svc:8080 http://svc:8080/metrics "},
+		},
+		{
+			upstream: "dns+http://svc:8080/metrics?a=b",
+			want: []string{
+				"10.0.0.1 http://10.0.0.1:8080/metrics?a=b svc",
+				"fd00::1 http://[fd00::1]:8080/metrics?a=b svc",
+			},
+		},
+		{
+			upstream: "dns+http://svc/metrics",
+			want: []string{
+				"10.0.0.1 http://10.0.0.1/metrics svc",
+				"fd00::1 http://[fd00::1]/metrics svc",
+			},
+		},
+		{
+			upstream: "dnssrv+http://_metrics._tcp.svc/metrics",
+			want: []string{
+				"10.0.0.2:9100 http://10.0.0.2:9100/metrics pod-a",
+				"10.0.0.3:9200 http://10.0.0.3:9200/metrics pod-b",
+			},
+		},
+		{
+			upstream: "dnssrvnoa+http://_metrics._tcp.svc/metrics",
+			want: []string{
+				"pod-a:9100 http://pod-a:9100/metrics ",
+				"pod-b:9200 http://pod-b:9200/metrics ",
+			},
+		},
+		{
+			upstream: "dns+http://unknown/metrics",
+			err:      true,
+		},
+	}
+	for _, c := range cases {
+		u := &UpstreamConfig{URL: c.upstream}
+		if err := u.init(); err != nil {
+			t.Fatal(err)
+		}
+		proxy := NewProxy(&Options{Upstreams: []*UpstreamConfig{u}, Timeout: time.Second}, slog.New(slog.DiscardHandler))
+		proxy.resolver = resolver
+		targets, err := proxy.targets()
+		if (err != nil) != c.err {
+			t.Errorf("(%s) unexpected error %v", c.upstream, err)
+		}
+		var got []string
+		for _, t := range targets {
+			got = append(got, t.Name+" "+t.URL+" "+t.Host)
+		}
+		if !slices.Equal(got, c.want) {
+			t.Errorf("(%s) got %q, want %q", c.upstream, got, c.want)
+		}
+	}
+}
+
+func TestRelabelTargets(t *testing.T) {
+	resolver := &stubResolver{
+		ips: map[string][]string{"pod-a": {"10.0.0.2"}, "pod-b": {"10.0.0.3"}},
+		srvs: map[string][]*net.SRV{
+			"_metrics._tcp.svc": {{Target: "pod-a", Port: 9100}, {Target: "pod-b", Port: 9200}},
+		},
+	}
+	var cfg Config
+	err := yaml.Unmarshal([]byte(`
+relabel_configs:
+- source_labels: [__meta_dns_srv_record_target]
+  regex: pod-b
+  action: drop
+- source_labels: [__meta_upstream_ip]
+  target_label: __address__
+  replacement: $1:8080
+- source_labels: [__meta_dns_srv_record_target]
+  target_label: pod
+`), &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for upstream, want := range map[string]string{
+		"dnssrv+http://_metrics._tcp.svc/metrics": `10.0.0.2:8080 http://10.0.0.2:8080/metrics {pod="pod-a"}`,
+		"dns+http://pod-a:9100/metrics":           `10.0.0.2:8080 http://10.0.0.2:8080/metrics {}`,
+	} {
+		u := &UpstreamConfig{URL: upstream}
+		if err := u.init(); err != nil {
+			t.Fatal(err)
+		}
+		proxy := NewProxy(&Options{Upstreams: []*UpstreamConfig{u}, TargetRelabel: cfg.TargetRelabel, Timeout: time.Second}, slog.New(slog.DiscardHandler))
+		proxy.resolver = resolver
+		targets, err := proxy.targets()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(targets) != 1 {
+			t.Fatalf("(%s) got %d targets, want 1", upstream, len(targets))
+		}
+		got := targets[0].Name + " " + targets[0].URL + " " + targets[0].Labels.String()
+		if got != want {
+			t.Errorf("(%s) got %s, want %s", upstream, got, want)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// familyBuffer holds samples of a histogram or summary family, to relabel them by groups with --family-relabel
+type familyBuffer struct {
+	family  string
+	m       *Meta
+	samples []familySample
+	gb      *labels.Builder // for group label sets
+}
+
+type familySample struct {
+	metricName string
+	lbls       labels.Labels
+	value      SVal
+	fn         AggFunc
+	group      string // label set without `le` and `quantile`
+}
+
+// baseFamily returns the family name for `__family__` label. Counter families are named with `_total` in textformat
+// and protobuf, but without it in OpenMetrics, so it is stripped to be the same for any upstream format
+func baseFamily(family string, m *Meta) string {
+	if m != nil && m.Type == "counter" {
+		return strings.TrimSuffix(family, "_total")
+	}
+	return family
+}
+
+// isGrouped returns true for the types which have multiple series per label set
+func isGrouped(m *Meta) bool {
+	return m != nil && (m.Type == "histogram" || m.Type == "gaugehistogram" || m.Type == "summary")
+}
+
+// push buffers the sample of the family
+func (fb *familyBuffer) push(metricName string, lbls labels.Labels, value SVal, fn AggFunc) {
+	group := lbls
+	if strings.HasSuffix(metricName, "_bucket") || metricName == fb.family {
+		if fb.gb == nil {
+			fb.gb = labels.NewBuilder(labels.EmptyLabels())
+		}
+		fb.gb.Reset(lbls)
+		group = fb.gb.Del("le", "quantile").Labels()
+	}
+	fb.samples = append(fb.samples, familySample{metricName: metricName, lbls: lbls, value: value, fn: fn, group: labelsString(group)})
+}
+
+// flush relabels buffered samples of the family. When any series of a group with the same labels is dropped in a subset,
+// the whole group is dropped, so histograms and summaries are never left incomplete
+func (p *Proxy) flush(lb *labels.Builder, fb *familyBuffer, t *Target, series map[string]*Series) {
+	if len(fb.samples) == 0 {
+		return
+	}
+	out := make([]string, len(fb.samples))
+	for subset, mrc := range p.Opts.Relabel {
+		dropped := make(map[string]bool)
+		for i, s := range fb.samples {
+			ls, keep := p.relabel(lb, s.metricName, s.lbls, fb.family, fb.m, t, mrc)
+			out[i] = ls
+			if !keep {
+				dropped[s.group] = true
+			}
+		}
+		added := false
+		for i, s := range fb.samples {
+			if !dropped[s.group] {
+				series[subset].Add(s.metricName, out[i], s.value, s.fn)
+				added = true
+			}
+		}
+		if added {
+			series[subset].SetMeta(fb.family, fb.m)
+		}
+	}
+	fb.samples = fb.samples[:0]
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/prometheus/model/relabel"
+)
+
+func TestFamilyRelabel(t *testing.T) {
+	input := m(
+		`# TYPE req_seconds histogram`,
+		`req_seconds_bucket{code="200",le="1"} 1`,
+		`req_seconds_bucket{code="200",le="+Inf"} 2`,
+		`req_seconds_sum{code="200"} 3`,
+		`req_seconds_count{code="200"} 2`,
+		`req_seconds_bucket{code="500",le="1"} 1`,
+		`req_seconds_bucket{code="500",le="+Inf"} 1`,
+		`req_seconds_sum{code="500"} 0.5`,
+		`req_seconds_count{code="500"} 1`,
+		`# TYPE rpc_seconds summary`,
+		`rpc_seconds{code="200",quantile="0.5"} 0.1`,
+		`rpc_seconds{code="200",quantile="0.9"} 0.2`,
+		`rpc_seconds_sum{code="200"} 1`,
+		`rpc_seconds_count{code="200"} 5`,
+		`# TYPE up gauge`,
+		`up 1`,
+	)
+	cfg, err := parseRelabel([]byte(`
+metric_relabel_configs:
+- source_labels: [__name__, code]
+  regex: req_seconds_count;500
+  action: drop
+- source_labels: [__name__, quantile]
+  regex: rpc_seconds;0.9
+  action: drop
+families:
+- source_labels: [__family__]
+  regex: req_seconds
+  action: keep
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := NewProxy(&Options{Relabel: cfg.relabel(), FamilyRelabel: true}, slog.New(slog.DiscardHandler))
+	subsets := map[string]*Series{default_subset: NewSeries(), "families": NewSeries()}
+	if _, err := proxy.parse(context.Background(), strings.NewReader(input), expfmt.TypeTextPlain, nil, subsets); err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]string{
+		default_subset: m(
+			`# TYPE req_seconds histogram`,
+			`req_seconds_bucket{code="200",le="1.0"} 1`,
+			`req_seconds_bucket{code="200",le="+Inf"} 2`,
+			`req_seconds_count{code="200"} 2`,
+			`req_seconds_sum{code="200"} 3`,
+			`# TYPE up gauge`,
+			`up 1`,
+		),
+		"families": m(
+			`# TYPE req_seconds histogram`,
+			`req_seconds_bucket{code="200",le="1.0"} 1`,
+			`req_seconds_bucket{code="200",le="+Inf"} 2`,
+			`req_seconds_bucket{code="500",le="1.0"} 1`,
+			`req_seconds_bucket{code="500",le="+Inf"} 1`,
+			`req_seconds_count{code="200"} 2`,
+			`req_seconds_count{code="500"} 1`,
+			`req_seconds_sum{code="200"} 3`,
+			`req_seconds_sum{code="500"} 0.5`,
+		),
+	}
+	for subset, want := range cases {
+		var b strings.Builder
+		render(subsets[subset], 0, expfmt.TypeTextPlain, &b)
+		if res := strings.TrimSpace(b.String()); res != want {
+			t.Errorf("%s got: '%s', want '%s'", subset, res, want)
+		}
+	}
+}
+
+func TestFamilyCounter(t *testing.T) {
+	text := m(`# TYPE requests_total counter`, `requests_total 1`, `# TYPE other gauge`, `other 1`)
+	series := NewSeries()
+	plain := NewProxy(&Options{Relabel: map[string][]*relabel.Config{default_subset: {}}}, slog.New(slog.DiscardHandler))
+	if _, err := plain.parse(context.Background(), strings.NewReader(text), expfmt.TypeTextPlain, nil, map[string]*Series{default_subset: series}); err != nil {
+		t.Fatal(err)
+	}
+	var proto bytes.Buffer
+	render(series, 0, expfmt.TypeProtoDelim, &proto)
+
+	cfg, err := parseRelabel([]byte(`
+metric_relabel_configs:
+- source_labels: [__family__]
+  regex: requests
+  action: keep
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := NewProxy(&Options{Relabel: cfg.relabel(), FamilyRelabel: true}, slog.New(slog.DiscardHandler))
+	cases := []struct {
+		name   string
+		format expfmt.FormatType
+		input  string
+	}{
+		{"text", expfmt.TypeTextPlain, text},
+		{"openmetrics", expfmt.TypeOpenMetrics, m(`# TYPE requests counter`, `requests_total 1`, `# TYPE other gauge`, `other 1`, `# EOF`)},
+		{"protobuf", expfmt.TypeProtoDelim, proto.String()},
+	}
+	for _, c := range cases {
+		subsets := map[string]*Series{default_subset: NewSeries()}
+		if _, err := proxy.parse(context.Background(), strings.NewReader(c.input), c.format, nil, subsets); err != nil {
+			t.Fatal(err)
+		}
+		var b strings.Builder
+		render(subsets[default_subset], 0, expfmt.TypeTextPlain, &b)
+		if res, want := strings.TrimSpace(b.String()), m(`# TYPE requests_total counter`, `requests_total 1`); res != want {
+			t.Errorf("%s got: '%s', want '%s'", c.name, res, want)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/prometheus/model/labels"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// k8sClient returns client from KUBECONFIG or in-cluster config, and the default namespace
+func k8sClient() (kubernetes.Interface, string, error) {
+	cc := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(clientcmd.NewDefaultClientConfigLoadingRules(), &clientcmd.ConfigOverrides{})
+	cfg, err := cc.ClientConfig()
+	if err != nil {
+		return nil, "", err
+	}
+	ns, _, err := cc.Namespace()
+	if err != nil {
+		return nil, "", err
+	}
+	client, err := kubernetes.NewForConfig(cfg)
+	return client, ns, err
+}
+
+// k8sSD watches EndpointSlices of the Service from upstream URL like `k8s+http://service.namespace:port/metrics`
+type k8sSD struct {
+	sdState
+	upstream  *UpstreamConfig
+	namespace string
+	service   string
+	lister    cache.Indexer
+}
+
+// newK8sSD starts the informer and waits for the initial list of EndpointSlices
+func newK8sSD(ctx context.Context, u *UpstreamConfig, client kubernetes.Interface, namespace string, logger *slog.Logger) (*k8sSD, error) {
+	d := &k8sSD{sdState: sdState{logger: logger, health: sdHealth{Name: u.URL}}, upstream: u, namespace: namespace}
+	parts := strings.SplitN(u.resolve.Hostname(), ".", 3)
+	d.service = parts[0]
+	if len(parts) > 1 {
+		d.namespace = parts[1]
+	}
+
+	factory := informers.NewSharedInformerFactoryWithOptions(client, 0,
+		informers.WithNamespace(d.namespace),
+		informers.WithTweakListOptions(func(o *metav1.ListOptions) {
+			o.LabelSelector = discoveryv1.LabelServiceName + "=" + d.service
+		}),
+	)
+	informer := factory.Discovery().V1().EndpointSlices().Informer()
+	informer.SetWatchErrorHandler(func(_ *cache.Reflector, err error) {
+		d.check(err)
+	})
+	_, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(any) { d.update() },
+		UpdateFunc: func(old, cur any) {
+			if !equality.Semantic.DeepEqual(old, cur) {
+				d.update()
+			}
+		},
+		DeleteFunc: func(any) { d.update() },
+	})
+	if err != nil {
+		return nil, err
+	}
+	d.lister = informer.GetIndexer()
+	factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		return nil, fmt.Errorf("error syncing EndpointSlices of %s/%s", d.namespace, d.service)
+	}
+	d.update()
+	return d, nil
+}
+
+// update rebuilds targets from all the EndpointSlices of the Service
+func (d *k8sSD) update() {
+	var res []*Target
+	for _, obj := range d.lister.List() {
+		if eps, ok := obj.(*discoveryv1.EndpointSlice); ok {
+			res = append(res, d.targets(eps)...)
+		}
+	}
+	d.set(res)
+	d.check(nil)
+	d.logger.Debug("Updated EndpointSlices", "service", d.namespace+"/"+d.service, "targets", len(res))
+}
+
+// targets returns a target per address and port of the EndpointSlice, or per address when port is set in URL.
+// Dual-stack Services have a slice per address family, only the configured one is used and FQDN slices are skipped
+func (d *k8sSD) targets(eps *discoveryv1.EndpointSlice) []*Target {
+	if string(eps.AddressType) != d.upstream.AddressType {
+		return nil
+	}
+	type port struct{ name, port string }
+	var ports []port
+	if p := d.upstream.resolve.Port(); p != "" {
+		ports = []port{{port: p}}
+	} else {
+		for _, p := range eps.Ports {
+			if p.Port != nil {
+				ports = append(ports, port{name: ptrString(p.Name), port: strconv.Itoa(int(*p.Port))})
+			}
+		}
+	}
+	if len(ports) == 0 {
+		ports = []port{{}} // default for the scheme
+	}
+
+	var res []*Target
+	for _, ep := range eps.Endpoints {
+		ready := ep.Conditions.Ready == nil || *ep.Conditions.Ready
+		if !ready && !d.upstream.IncludeNotReady || len(ep.Addresses) == 0 {
+			continue
+		}
+		b := labels.NewBuilder(labels.EmptyLabels())
+		b.Set("__meta_kubernetes_namespace", eps.Namespace)
+		b.Set("__meta_kubernetes_service_name", d.service)
+		b.Set("__meta_kubernetes_endpointslice_name", eps.Name)
+		b.Set("__meta_kubernetes_endpointslice_endpoint_conditions_ready", strconv.FormatBool(ready))
+		b.Set("__meta_kubernetes_endpointslice_endpoint_node_name", ptrString(ep.NodeName))
+		b.Set("__meta_kubernetes_endpointslice_endpoint_zone", ptrString(ep.Zone))
+		if ep.Hostname != nil {
+			b.Set("__meta_kubernetes_endpointslice_endpoint_hostname", *ep.Hostname)
+		}
+		name := ""
+		if ref := ep.TargetRef; ref != nil {
+			b.Set("__meta_kubernetes_endpointslice_address_target_kind", ref.Kind)
+			b.Set("__meta_kubernetes_endpointslice_address_target_name", ref.Name)
+			if ref.Kind == "Pod" {
+				b.Set("__meta_kubernetes_pod_name", ref.Name)
+				name = ref.Name
+			}
+		}
+		addr := ep.Addresses[0] // the rest are the same endpoint
+		for _, p := range ports {
+			b.Set("__meta_kubernetes_endpointslice_port", p.port)
+			b.Set("__meta_kubernetes_endpointslice_port_name", p.name)
+			t := d.upstream.target(addr, p.port, "", addr)
+			switch {
+			case name != "" && len(ports) == 1:
+				t.Name = name
+			case name != "":
+				t.Name = name + ":" + p.port
+			case p.port != "":
+				t.Name = net.JoinHostPort(addr, p.port)
+			}
+			t.Meta = b.Labels()
+			res = append(res, t)
+		}
+	}
+	return res
+}
+
+func ptrString(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
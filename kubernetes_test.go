@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/utils/ptr"
+)
+
+func TestK8sSD(t *testing.T) {
+	eps := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "ingress-abc",
+			Namespace: "ingress",
+			Labels:    map[string]string{discoveryv1.LabelServiceName: "ingress"},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+		Ports:       []discoveryv1.EndpointPort{{Name: ptr.To("metrics"), Port: ptr.To[int32](10254)}},
+		Endpoints: []discoveryv1.Endpoint{
+			{
+				Addresses:  []string{"10.0.0.1"},
+				Conditions: discoveryv1.EndpointConditions{Ready: ptr.To(true)},
+				NodeName:   ptr.To("node-1"),
+				TargetRef:  &corev1.ObjectReference{Kind: "Pod", Name: "ingress-1"},
+			},
+			{
+				Addresses:  []string{"10.0.0.2"},
+				Conditions: discoveryv1.EndpointConditions{Ready: ptr.To(false)},
+				TargetRef:  &corev1.ObjectReference{Kind: "Pod", Name: "ingress-2"},
+			},
+		},
+	}
+	other := eps.DeepCopy()
+	other.Name, other.Labels = "other-abc", map[string]string{discoveryv1.LabelServiceName: "other"}
+	// dual-stack Service has a slice per address family
+	v6 := eps.DeepCopy()
+	v6.Name, v6.AddressType = "ingress-def", discoveryv1.AddressTypeIPv6
+	v6.Endpoints[0].Addresses, v6.Endpoints[1].Addresses = []string{"fd00::1"}, []string{"fd00::2"}
+	client := fake.NewClientset(eps, other, v6)
+
+	u := &UpstreamConfig{URL: "k8s+http://ingress/metrics"}
+	if err := u.init(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d, err := newK8sSD(ctx, u, client, "ingress", slog.New(slog.DiscardHandler))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := d.Targets()
+	if len(ts) != 1 {
+		t.Fatalf("got %d targets, want 1", len(ts))
+	}
+	if ts[0].URL != "http://10.0.0.1:10254/metrics" || ts[0].Name != "ingress-1" {
+		t.Errorf("unexpected target %s %s", ts[0].URL, ts[0].Name)
+	}
+	for name, want := range map[string]string{
+		"__meta_kubernetes_pod_name":                                "ingress-1",
+		"__meta_kubernetes_endpointslice_endpoint_node_name":        "node-1",
+		"__meta_kubernetes_endpointslice_port_name":                 "metrics",
+		"__meta_kubernetes_endpointslice_endpoint_conditions_ready": "true",
+	} {
+		if got := ts[0].Meta.Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+
+	// the second pod becomes ready
+	eps.Endpoints[1].Conditions.Ready = ptr.To(true)
+	if _, err := client.DiscoveryV1().EndpointSlices("ingress").Update(ctx, eps, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(d.Targets()) != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d targets after update, want 2", len(d.Targets()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	u6 := &UpstreamConfig{URL: "k8s+http://ingress/metrics", AddressType: "IPv6"}
+	if err := u6.init(); err != nil {
+		t.Fatal(err)
+	}
+	d6, err := newK8sSD(ctx, u6, client, "ingress", slog.New(slog.DiscardHandler))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ts := d6.Targets(); len(ts) != 1 || ts[0].URL != "http://[fd00::1]:10254/metrics" {
+		t.Errorf("unexpected IPv6 targets %v", ts)
+	}
+}
@@ -1,41 +1,75 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
 	"net/http"
-	"net/url"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
-	_ "net/http/pprof"
+	"net/http/pprof"
 
+	"github.com/prometheus/common/config"
 	"github.com/prometheus/common/version"
+	"github.com/prometheus/exporter-toolkit/web"
 	"github.com/prometheus/prometheus/model/relabel"
 	"github.com/spf13/pflag"
-	"gopkg.in/yaml.v2"
+	"k8s.io/client-go/kubernetes"
 )
 
 const default_subset = "metric_relabel_configs"
 
 type Options struct {
-	File     string
-	Upstream string
-	Relabel  map[string][]*relabel.Config
-	Port     int
-	Timeout  time.Duration
-	Resolve  *url.URL
+	File              string
+	Upstream          string // the first one, for /source and /analyze
+	Upstreams         []*UpstreamConfig
+	ConfigFile        string // to reload
+	RelabelFile       string
+	Relabel           map[string][]*relabel.Config
+	TargetRelabel     []*relabel.Config
+	Aggregation       []*AggregationConfig
+	Buckets           []*BucketConfig
+	FamilyRelabel     bool // relabel histograms and summaries by groups of the same labels
+	Port              int
+	AdminPort         int // for /analyze and /debug/pprof, 0 = the same as Port
+	Timeout           time.Duration
+	ScrapeInterval    time.Duration // 0 = scrape on each /metrics request
+	CoalesceWindow    time.Duration // 0 = no sharing of scrapes between /metrics requests
+	MaxStaleness      time.Duration // of the last successful upstream result, 0 = disabled
+	ServeStaleFor     time.Duration // of the last successful scrape when all upstreams fail, 0 = disabled
+	CompressionLevel  int           // 0 = default
+	ResetCompensation bool
+	Discovery         []Discoverer
+	HTTPClient        *http.Client // for upstreams, from upstream_http_config
 }
 
 func main() {
 	var opts Options
 	pflag.StringVarP(&opts.File, "file", "f", "", "Analyze file for metrics and label cardinality and exit")
-	pflag.StringVarP(&opts.Upstream, "upstream", "H", "http://localhost:10254/metrics", "Source URL to get metrics from. The scheme may be prefixed with 'dns+' to resolve and aggregate multiple targets")
+	var upstreams = pflag.StringArrayP("upstream", "H", []string{"http://localhost:10254/metrics"}, "Source URL to get metrics from, could be repeated to aggregate multiple targets. The scheme may be prefixed with 'dns+', 'dnssrv+', 'dnssrvnoa+' or 'k8s+' to resolve and aggregate multiple targets")
 	var re = pflag.StringP("relabel", "", "", "Contents of yaml file with metric_relabel_configs")
 	var reFile = pflag.StringP("relabel-file", "", "", "Path to yaml file with metric_relabel_configs (mutually exclusive)")
+	pflag.StringVarP(&opts.ConfigFile, "config.file", "c", "", "Path to yaml config file with all the settings, flags override its values (mutually exclusive with relabel)")
+	var watch = pflag.DurationP("config.watch-interval", "", 0, "Interval to check config.file or relabel-file for changes and reload it, 0 to only reload on SIGHUP or POST /-/reload")
+	var sdFile = pflag.StringP("upstream-sd-file", "", "", "Path to json/yaml file with upstream targets in Prometheus file_sd_config format")
+	var sdURL = pflag.StringP("upstream-sd-url", "", "", "URL of Prometheus http_sd_config compatible endpoint to get upstream targets from")
+	var sdRefresh = pflag.DurationP("upstream-sd-refresh", "", 30*time.Second, "Interval to check service discovery for changes")
 	pflag.DurationVarP(&opts.Timeout, "scrape-timeout", "t", 15*time.Second, "Timeout for upstream requests")
+	pflag.DurationVarP(&opts.ScrapeInterval, "scrape-interval", "", 0, "Interval to scrape upstreams in background and serve all the endpoints from the last result, 0 to scrape on each /metrics request")
+	pflag.DurationVarP(&opts.CoalesceWindow, "scrape-coalesce-window", "", 0, "Requests to /metrics arriving within this time after the upstream scrape has started share its result, 0 to scrape for each request")
+	pflag.DurationVarP(&opts.MaxStaleness, "upstream-max-staleness", "", 0, "Use the last successful result of an upstream when its scrape fails, until it is older than this. 0 to drop failed upstreams from the result")
+	pflag.DurationVarP(&opts.ServeStaleFor, "serve-stale-for", "", 0, "Serve the last successful result with its timestamps when all the upstreams fail, until it is older than this. 0 to return error")
 	pflag.IntVarP(&opts.Port, "port", "p", 8080, "Port to serve aggregated metrics on")
+	pflag.IntVarP(&opts.CompressionLevel, "compression-level", "", 0, "Level 1-9 of gzip/zstd compression of responses, 0 for the default level")
+	var webConfig = pflag.StringP("web.config.file", "", "", "Path to exporter-toolkit web config file to enable TLS and authentication")
+	pflag.IntVarP(&opts.AdminPort, "web.admin-port", "", 0, "Port to serve /analyze and /debug/pprof on separately from metrics (default is --port)")
+	var adminWebConfig = pflag.StringP("web.admin-config.file", "", "", "Path to exporter-toolkit web config file for --web.admin-port")
+	pflag.BoolVarP(&opts.FamilyRelabel, "family-relabel", "", false, "Expose __family__ label to metric_relabel_configs, and drop all the series of a histogram or summary with the same labels when any of them is dropped")
+	pflag.BoolVarP(&opts.ResetCompensation, "counter-reset-compensation", "", false, "Keep aggregated counters monotonic when upstreams restart or are gone")
 	var ver = pflag.BoolP("version", "v", false, "Show version and exit")
 	var logLevel = pflag.StringP("log-level", "", "info", "Log level (info, debug)")
 	pflag.Parse()
@@ -51,74 +85,153 @@ func main() {
 		os.Exit(0)
 	}
 
-	if !strings.Contains(opts.Upstream, "://") {
-		opts.Upstream = "http://" + opts.Upstream
-	}
-	if *re != "" && *reFile != "" {
-		logger.Error("Error: both `relabel` and `relabel-file` specified")
+	cfg, err := loadConfig(*re, *reFile, opts.ConfigFile)
+	if err != nil {
+		logger.Error("Error loading config", "err", err)
 		os.Exit(1)
 	}
-	if *reFile != "" {
-		data, err := os.ReadFile(*reFile)
-		if err != nil {
-			logger.Error("Error reading relabel-file", "err", err)
-			os.Exit(1)
+	for name, value := range cfg.Global.flags(cfg.UpstreamSD) {
+		if pflag.CommandLine.Changed(name) {
+			continue
 		}
-		err = yaml.Unmarshal(data, &opts.Relabel)
-		if err != nil {
-			logger.Error("Error parsing relabel-file", "err", err)
+		if err := pflag.Set(name, value); err != nil {
+			logger.Error("Error in config global settings", "flag", name, "err", err)
 			os.Exit(1)
 		}
 	}
-	if *re != "" {
-		err := yaml.Unmarshal([]byte(*re), &opts.Relabel)
+	logger = getLogger(*logLevel)
+	opts.RelabelFile = *reFile
+	opts.Relabel, opts.Aggregation, opts.TargetRelabel = cfg.relabel(), cfg.Aggregation, cfg.TargetRelabel
+	opts.Buckets = cfg.Buckets
+	opts.Upstreams = cfg.Upstreams
+	if len(cfg.Upstreams) == 0 && *sdFile == "" && *sdURL == "" || pflag.CommandLine.Changed("upstream") {
+		opts.Upstreams = nil
+		for _, u := range *upstreams {
+			opts.Upstreams = append(opts.Upstreams, &UpstreamConfig{URL: u})
+		}
+	}
+	if cfg.HTTPConfig != nil {
+		client, err := config.NewClientFromConfig(*cfg.HTTPConfig, "metric-gate")
 		if err != nil {
-			logger.Error("Error parsing relabel", "err", err)
+			logger.Error("Error creating client from upstream_http_config", "err", err)
 			os.Exit(1)
 		}
+		opts.HTTPClient = client
 	}
-	for s := range opts.Relabel {
-		for _, r := range opts.Relabel[s] {
-			if err := r.Validate(); err != nil {
-				logger.Error("Error validating relabel config", "section", s, "err", err)
+	var static []*UpstreamConfig
+	var k8s kubernetes.Interface
+	var namespace string
+	for _, u := range opts.Upstreams {
+		if err := u.init(); err != nil {
+			logger.Error("Error in upstream config", "err", err)
+			os.Exit(1)
+		}
+		if u.mode != "k8s" {
+			static = append(static, u)
+			continue
+		}
+		if k8s == nil {
+			var err error
+			if k8s, namespace, err = k8sClient(); err != nil {
+				logger.Error("Error creating kubernetes client", "err", err)
 				os.Exit(1)
 			}
 		}
+		d, err := newK8sSD(context.Background(), u, k8s, namespace, logger)
+		if err != nil {
+			logger.Error("Error watching kubernetes EndpointSlices", "upstream", u.URL, "err", err)
+			os.Exit(1)
+		}
+		opts.Discovery = append(opts.Discovery, d)
 	}
-	if len(opts.Relabel) > 0 && opts.Relabel[default_subset] == nil {
-		logger.Error("Error: relabel config key `metric_relabel_configs` is not defined")
-		os.Exit(1)
+	opts.Upstreams = static
+	if len(opts.Upstreams) > 0 {
+		opts.Upstream = opts.Upstreams[0].URL
 	}
-	if len(opts.Relabel) == 0 {
-		opts.Relabel = map[string][]*relabel.Config{
-			default_subset: {},
+	if *sdFile != "" {
+		d, err := newFileSD(*sdFile, logger)
+		if err != nil {
+			logger.Error("Error reading upstream-sd-file", "err", err)
+			os.Exit(1)
 		}
+		go d.run(context.Background(), *sdRefresh, d.refresh)
+		opts.Discovery = append(opts.Discovery, d)
 	}
-
-	if strings.HasPrefix(opts.Upstream, "dns+") {
-		opts.Upstream = opts.Upstream[4:]
-		parts, err := url.Parse(opts.Upstream)
-		if err != nil {
-			logger.Error("Error parsing upstream as url", "err", err)
+	if *sdURL != "" {
+		d := newHTTPSD(*sdURL, opts.Timeout, logger)
+		go d.run(context.Background(), *sdRefresh, d.refresh)
+		opts.Discovery = append(opts.Discovery, d)
+	}
+	if opts.CompressionLevel < 0 || opts.CompressionLevel > 9 {
+		logger.Error("Error: compression-level should be 0-9", "level", opts.CompressionLevel)
+		os.Exit(1)
+	}
+	for _, f := range []string{*webConfig, *adminWebConfig} {
+		if f == "" {
+			continue
+		}
+		if err := web.Validate(f); err != nil {
+			logger.Error("Error validating web config", "file", f, "err", err)
 			os.Exit(1)
 		}
-		opts.Resolve = parts
 	}
 
 	proxy := NewProxy(&opts, logger)
-	http.HandleFunc("/", proxy.index)
-	http.HandleFunc("/source", proxy.src)
-	http.HandleFunc("/analyze", proxy.analyze)
-	http.HandleFunc("/metrics", proxy.agg)
-	http.HandleFunc("/metrics/", proxy.agg)
-	http.HandleFunc("/metrics/{subset}", proxy.agg)
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		for range hup {
+			proxy.reload()
+		}
+	}()
+	if opts.ScrapeInterval > 0 {
+		go proxy.scrapeLoop(context.Background(), opts.ScrapeInterval)
+	}
+	if proxy.configPath() != "" && *watch > 0 {
+		go proxy.watchConfig(context.Background(), *watch)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", proxy.index)
+	mux.HandleFunc("/source", proxy.src)
+	mux.HandleFunc("/metrics", proxy.agg)
+	mux.HandleFunc("/metrics/", proxy.agg)
+	mux.HandleFunc("/metrics/{subset}", proxy.agg)
+	mux.Handle("/-/metrics", selfMetrics())
+	admin := mux
+	if opts.AdminPort != 0 {
+		admin = http.NewServeMux()
+		go func() {
+			logger.Info("Starting admin server", "port", opts.AdminPort)
+			if err := serve(admin, opts.AdminPort, *adminWebConfig, logger); err != nil {
+				logger.Error("Error starting admin server", "err", err)
+				os.Exit(1)
+			}
+		}()
+	}
+	admin.HandleFunc("/analyze", proxy.analyze)
+	admin.HandleFunc("/-/reload", proxy.reloadHandler)
+	admin.HandleFunc("/debug/pprof/", pprof.Index)
+	admin.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	admin.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	admin.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	admin.HandleFunc("/debug/pprof/trace", pprof.Trace)
 	logger.Info("Starting server", "port", opts.Port, "version", version.Version)
-	if err := http.ListenAndServe(fmt.Sprintf(":%d", opts.Port), nil); err != nil {
+	if err := serve(mux, opts.Port, *webConfig, logger); err != nil {
 		logger.Error("Error starting server", "err", err)
 		os.Exit(1)
 	}
 }
 
+// serve listens on `port` with TLS and auth from exporter-toolkit web config, which is re-read on each request
+func serve(handler http.Handler, port int, webConfig string, logger *slog.Logger) error {
+	systemd := false
+	return web.ListenAndServe(&http.Server{Handler: handler}, &web.FlagConfig{
+		WebListenAddresses: &[]string{fmt.Sprintf(":%d", port)},
+		WebSystemdSocket:   &systemd,
+		WebConfigFile:      &webConfig,
+	}, logger)
+}
+
 func getLogger(logLevel string) *slog.Logger {
 	var l = slog.LevelInfo
 	if logLevel == "debug" {
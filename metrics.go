@@ -0,0 +1,132 @@
+package main
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// self-instrumentation, served on /-/metrics
+var (
+	registry = prometheus.NewRegistry()
+	factory  = promauto.With(registry)
+
+	scrapeDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "metric_gate_scrape_duration_seconds",
+		Help:    "Duration of upstream scrapes, including parsing",
+		Buckets: []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"upstream"})
+	scrapedSamples = factory.NewCounter(prometheus.CounterOpts{
+		Name: "metric_gate_scraped_samples_total",
+		Help: "Number of samples parsed from upstreams",
+	})
+	scrapeErrors = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "metric_gate_scrape_errors_total",
+		Help: "Number of failed upstream scrapes, by stage",
+	}, []string{"stage"})
+	scrapeTruncated = factory.NewCounter(prometheus.CounterOpts{
+		Name: "metric_gate_scrape_truncated_total",
+		Help: "Number of upstream responses truncated by scrape timeout",
+	})
+	upstreamFallbacks = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "metric_gate_upstream_stale_fallbacks_total",
+		Help: "Number of failed upstream scrapes replaced by the last successful result",
+	}, []string{"upstream"})
+	staleResponses = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "metric_gate_stale_responses_total",
+		Help: "Number of responses served from the last successful scrape, as all the upstreams failed",
+	}, []string{"subset"})
+	coalescedRequests = factory.NewCounter(prometheus.CounterOpts{
+		Name: "metric_gate_coalesced_requests_total",
+		Help: "Number of /metrics requests served from the upstream scrape of a concurrent request",
+	})
+	seriesIn = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "metric_gate_subset_series_in",
+		Help: "Number of samples left after relabeling in the last scrape, before aggregation",
+	}, []string{"subset"})
+	seriesOut = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "metric_gate_subset_series_out",
+		Help: "Number of series after aggregation in the last scrape",
+	}, []string{"subset"})
+	renderDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "metric_gate_render_duration_seconds",
+		Help:    "Duration of rendering responses",
+		Buckets: []float64{.001, .005, .01, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"subset"})
+	responseBytes = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "metric_gate_response_bytes_total",
+		Help: "Number of bytes written in /metrics responses",
+	}, []string{"subset"})
+	reloadSuccess = factory.NewGauge(prometheus.GaugeOpts{
+		Name: "metric_gate_config_last_reload_successful",
+		Help: "Whether the last config reload attempt was successful",
+	})
+	reloadTimestamp = factory.NewGauge(prometheus.GaugeOpts{
+		Name: "metric_gate_config_last_reload_success_timestamp_seconds",
+		Help: "Timestamp of the last successful config reload",
+	})
+)
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	scrapeErrors.WithLabelValues("request")
+	scrapeErrors.WithLabelValues("parse")
+	reloadSuccess.Set(1) // the config is loaded on start
+	reloadTimestamp.SetToCurrentTime()
+}
+
+// selfMetrics serves metrics of metric-gate itself
+func selfMetrics() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// forgetUpstreams deletes self-metrics of upstreams which are not in `hosts` anymore, so they do not pile up with pods churn
+func (p *Proxy) forgetUpstreams(hosts []string) {
+	alive := make(map[string]bool, len(hosts))
+	for _, h := range hosts {
+		alive[h] = true
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for host := range p.observed {
+		if !alive[host] {
+			scrapeDuration.DeleteLabelValues(host)
+			upstreamFallbacks.DeleteLabelValues(host)
+		}
+	}
+	p.observed = alive
+}
+
+// observeSeries updates series in/out gauges of the subset
+func observeSeries(subset string, s *Series) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var in, out int
+	for _, seria := range s.data {
+		for _, v := range *seria {
+			in += v.n
+			out++
+		}
+	}
+	seriesIn.WithLabelValues(subset).Set(float64(in))
+	seriesOut.WithLabelValues(subset).Set(float64(out))
+}
+
+// countingWriter counts bytes written
+type countingWriter struct {
+	io.Writer
+	n int
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.Writer.Write(b)
+	w.n += n
+	return n, err
+}
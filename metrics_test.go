@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/regexp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/relabel"
+)
+
+func TestSelfMetrics(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `metric1{pod="a"} 1`)
+		fmt.Fprintln(w, `metric1{pod="b"} 2`)
+		fmt.Fprintln(w, `metric2{pod="a"} 3`)
+	}))
+	defer srv.Close()
+	proxy := NewProxy(&Options{
+		Upstreams: []*UpstreamConfig{{URL: srv.URL}},
+		Timeout:   time.Second,
+		Relabel: map[string][]*relabel.Config{
+			default_subset: {{Action: relabel.LabelDrop, Regex: relabel.Regexp{Regexp: regexp.MustCompile("pod")}}},
+			"sub":          {{Action: relabel.Drop, SourceLabels: []model.LabelName{"__name__"}, Regex: relabel.Regexp{Regexp: regexp.MustCompile("metric1")}}},
+		},
+	}, slog.New(slog.DiscardHandler))
+	w := httptest.NewRecorder()
+	proxy.agg(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d %s", w.Code, w.Body.String())
+	}
+
+	for _, c := range []struct {
+		subset  string
+		in, out float64
+	}{
+		{default_subset, 3, 2},
+		{"sub", 1, 1},
+	} {
+		if in, out := testutil.ToFloat64(seriesIn.WithLabelValues(c.subset)), testutil.ToFloat64(seriesOut.WithLabelValues(c.subset)); in != c.in || out != c.out {
+			t.Errorf("(%s) got series in/out %v/%v, want %v/%v", c.subset, in, out, c.in, c.out)
+		}
+	}
+	if n := testutil.ToFloat64(responseBytes.WithLabelValues(default_subset)); n < float64(w.Body.Len()) {
+		t.Errorf("got response bytes %v, want at least %d", n, w.Body.Len())
+	}
+
+	w = httptest.NewRecorder()
+	selfMetrics().ServeHTTP(w, httptest.NewRequest("GET", "/-/metrics", nil))
+	for _, want := range []string{"metric_gate_scrape_duration_seconds_count{upstream=", "metric_gate_scraped_samples_total", "go_goroutines"} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("missing %q in /-/metrics", want)
+		}
+	}
+}
+
+func TestForgetUpstreams(t *testing.T) {
+	proxy := NewProxy(&Options{}, slog.New(slog.DiscardHandler))
+	for _, host := range []string{"10.0.0.5", "10.0.0.6"} {
+		scrapeDuration.WithLabelValues(host).Observe(1)
+	}
+	upstreamFallbacks.WithLabelValues("10.0.0.6").Inc()
+	proxy.forgetUpstreams([]string{"10.0.0.5", "10.0.0.6"})
+	proxy.forgetUpstreams([]string{"10.0.0.5"})
+	if scrapeDuration.DeleteLabelValues("10.0.0.6") || upstreamFallbacks.DeleteLabelValues("10.0.0.6") {
+		t.Error("metrics of gone upstream are not deleted")
+	}
+	if !scrapeDuration.DeleteLabelValues("10.0.0.5") {
+		t.Error("metrics of alive upstream are deleted")
+	}
+}
@@ -3,7 +3,9 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"math"
 	"strconv"
+	"strings"
 
 	"github.com/prometheus/prometheus/model/labels"
 )
@@ -33,9 +35,64 @@ func labelsString(ls labels.Labels) string {
 	return b.String()
 }
 
+// parseLabels unpacks output of labelsString back, label values are kept escaped
+func parseLabels(ls string) labels.Labels {
+	_, lbls, _, _ := parseLine("_" + ls + " 0")
+	return lbls
+}
+
+// Meta is HELP/TYPE/UNIT metadata of a metric family
+type Meta struct {
+	Type string
+	Help string
+	Unit string
+}
+
+// suffixes of samples which belong to a family with a shorter name
+var familySuffixes = []string{"_bucket", "_sum", "_count", "_total", "_created", "_info", "_gsum", "_gcount"}
+
+// familyName returns metric family of `metricName` by known metadata, or metricName itself
+func familyName(metricName string, meta map[string]*Meta) string {
+	if meta[metricName] != nil {
+		return metricName
+	}
+	for _, s := range familySuffixes {
+		if base, ok := strings.CutSuffix(metricName, s); ok && meta[base] != nil {
+			return base
+		}
+	}
+	return metricName
+}
+
+// parseComment unpacks `# HELP`, `# TYPE` and `# UNIT` lines, returns empty kind for other comments
+func parseComment(line string) (kind, name, text string) {
+	line = strings.TrimLeft(line, " \t")
+	if !strings.HasPrefix(line, "# ") {
+		return "", "", ""
+	}
+	kind, rest, ok := strings.Cut(line[2:], " ")
+	if !ok || (kind != "HELP" && kind != "TYPE" && kind != "UNIT") {
+		return "", "", ""
+	}
+	name, text, _ = strings.Cut(strings.TrimLeft(rest, " "), " ")
+	if name == "" {
+		return "", "", ""
+	}
+	if kind != "HELP" {
+		text = strings.TrimSpace(text)
+	}
+	return kind, name, text
+}
+
 // parseLine is a simplified expfmt.TextToMetricFamilies to unpack textformat, returns empty metricName if line is a comment or blank
 // https://prometheus.io/docs/instrumenting/exposition_formats/
 func parseLine(line string) (name string, lbls labels.Labels, value SVal, err error) {
+	return parseSample(line, false)
+}
+
+// parseSample unpacks textformat or OpenMetrics (`om`) sample line, where timestamp is in seconds and exemplars are skipped
+// https://github.com/prometheus/OpenMetrics/blob/main/specification/OpenMetrics.md
+func parseSample(line string, om bool) (name string, lbls labels.Labels, value SVal, err error) {
 	i := 0
 	for ; i < len(line) && (line[i] == ' ' || line[i] == '\t'); i++ { // not needed
 	}
@@ -137,8 +194,14 @@ func parseLine(line string) (name string, lbls labels.Labels, value SVal, err er
 	j = i + 1
 	for ; j < len(line) && line[j] != ' '; j++ {
 	}
-	if i < len(line) {
-		value.TimestampMs, err = strconv.ParseInt(line[i:j], 10, 64)
+	if i < len(line) && line[i] != '#' { // exemplar
+		if om {
+			var ts float64
+			ts, err = strconv.ParseFloat(line[i:j], 64)
+			value.TimestampMs = int64(math.Round(ts * 1000))
+		} else {
+			value.TimestampMs, err = strconv.ParseInt(line[i:j], 10, 64)
+		}
 		if err != nil {
 			return "", nil, SVal{}, fmt.Errorf("invalid timestamp: %s", line)
 		}
@@ -146,3 +209,36 @@ func parseLine(line string) (name string, lbls labels.Labels, value SVal, err er
 
 	return name, lb.Labels(), value, nil
 }
+
+// formatBound formats `le` and `quantile` values as Prometheus 3 does, with `.0` for integers (`1.0`, but `+Inf` and `1e+06`)
+func formatBound(f float64) string {
+	s := strconv.FormatFloat(f, 'g', -1, 64)
+	if math.IsInf(f, 0) || math.IsNaN(f) || strings.ContainsAny(s, "e.") {
+		return s
+	}
+	return s + ".0"
+}
+
+// normalizeBound rewrites `le` of histogram buckets and `quantile` of summaries with formatBound, as exporters spell them
+// differently (`1` vs `1.0`), so the same series from upstreams of any format are aggregated together
+func normalizeBound(lb *labels.Builder, metricName, family string, lbls labels.Labels, m *Meta) labels.Labels {
+	var name string
+	switch {
+	case m == nil:
+		return lbls
+	case (m.Type == "histogram" || m.Type == "gaugehistogram") && metricName == family+"_bucket":
+		name = "le"
+	case m.Type == "summary" && metricName == family:
+		name = "quantile"
+	default:
+		return lbls
+	}
+	v := lbls.Get(name)
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || formatBound(f) == v {
+		return lbls
+	}
+	lb.Reset(lbls)
+	lb.Set(name, formatBound(f))
+	return lb.Labels()
+}
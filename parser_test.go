@@ -150,6 +150,84 @@ func TestParseLine(t *testing.T) {
 	}
 }
 
+func TestParseSampleOM(t *testing.T) {
+	cases := []struct {
+		line   string
+		name   string
+		labels string
+		value  SVal
+	}{
+		{
+			line:   `metric1_total 10 1751041454.123`,
+			name:   "metric1_total",
+			labels: "{}",
+			value:  SVal{Value: 10, TimestampMs: 1751041454123},
+		},
+		{
+			line:   `metric2_bucket{le="0.5"} 10 # {trace_id="KOO5S4vxi0o"} 0.67`,
+			name:   "metric2_bucket",
+			labels: `{le="0.5"}`,
+			value:  SVal{Value: 10},
+		},
+		{
+			line:   `metric3_total{code="200"} 1.5e3 1751041454 # {trace_id="a"} 1 1751041454.5`,
+			name:   "metric3_total",
+			labels: `{code="200"}`,
+			value:  SVal{Value: 1500, TimestampMs: 1751041454000},
+		},
+	}
+	for _, c := range cases {
+		name, labels, value, err := parseSample(c.line, true)
+		if err != nil {
+			t.Errorf("(%s) unexpected error %v", c.line, err)
+		}
+		if name != c.name || labelsString(labels) != c.labels || value != c.value {
+			t.Errorf("(%s) expected %s%s %v, got %s%s %v", c.line, c.name, c.labels, c.value, name, labelsString(labels), value)
+		}
+	}
+}
+
+func TestParseComment(t *testing.T) {
+	cases := []struct {
+		line string
+		kind string
+		name string
+		text string
+	}{
+		{line: `# helptext`},
+		{line: `#HELP metric1 text`},
+		{line: `# HELP`},
+		{line: `# HELP metric1`, kind: "HELP", name: "metric1"},
+		{line: `# HELP metric1 Some help\ntext `, kind: "HELP", name: "metric1", text: `Some help\ntext `},
+		{line: ` 	# TYPE metric2 counter `, kind: "TYPE", name: "metric2", text: "counter"},
+		{line: `# UNIT metric3_seconds seconds`, kind: "UNIT", name: "metric3_seconds", text: "seconds"},
+	}
+	for _, c := range cases {
+		kind, name, text := parseComment(c.line)
+		if kind != c.kind || name != c.name || text != c.text {
+			t.Errorf("(%s) expected %q %q %q, got %q %q %q", c.line, c.kind, c.name, c.text, kind, name, text)
+		}
+	}
+}
+
+func TestFamilyName(t *testing.T) {
+	meta := map[string]*Meta{
+		"histogram1":    {Type: "histogram"},
+		"counter_total": {Type: "counter"},
+	}
+	cases := map[string]string{
+		"histogram1_bucket": "histogram1",
+		"histogram1_count":  "histogram1",
+		"counter_total":     "counter_total",
+		"untyped_bucket":    "untyped_bucket",
+	}
+	for name, want := range cases {
+		if got := familyName(name, meta); got != want {
+			t.Errorf("familyName(%s) expected %s, got %s", name, want, got)
+		}
+	}
+}
+
 func BenchmarkParseLine(b *testing.B) {
 	s := `nginx_ingress_controller_request_duration_seconds_sum{canary="",controller_class="k8s.io/nginx-test",controller_namespace="ingress-nginx",controller_pod="ingress-nginx-controller-test-769b6d4b8c-kfh2r",ingress="helm-testing-t-7a97764ipl-test-services-helm-essential",method="GET",namespace="testing-t-7a97764ipl",path="/actuator/health",service="helm-testing-t-7a97764ipl-test-services-helm",status="2xx"} 151.3409999999997`
 	for b.Loop() {
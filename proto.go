@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/prometheus/model/labels"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+var protoTypes = map[dto.MetricType]string{
+	dto.MetricType_COUNTER:         "counter",
+	dto.MetricType_GAUGE:           "gauge",
+	dto.MetricType_SUMMARY:         "summary",
+	dto.MetricType_UNTYPED:         "untyped",
+	dto.MetricType_HISTOGRAM:       "histogram",
+	dto.MetricType_GAUGE_HISTOGRAM: "gaugehistogram",
+}
+
+var (
+	labelEscaper   = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	labelUnescaper = strings.NewReplacer(`\\`, `\`, `\"`, `"`, `\n`, "\n")
+)
+
+// parseProto unpacks and filters delimited protobuf, only classic buckets of histograms are used
+func (p *Proxy) parseProto(ctx context.Context, r io.Reader, t *Target, series map[string]*Series) (int, error) {
+	dec := expfmt.NewDecoder(r, expfmt.FmtProtoDelim)
+	lb := labels.NewBuilder(labels.EmptyLabels())
+	fb := &familyBuffer{}
+	defer p.flush(lb, fb, t, series)
+	bb := labels.NewBuilder(labels.EmptyLabels())
+	sb := labels.NewScratchBuilder(0)
+	var n int
+	var lastName string
+	var fn AggFunc
+	for {
+		mf := &dto.MetricFamily{}
+		if err := dec.Decode(mf); err != nil {
+			if err == io.EOF {
+				return n, nil
+			}
+			if ctx.Err() != nil {
+				p.logger.Warn("Scrape timeout reached, response truncated", "samples_parsed", n)
+				return n, nil
+			}
+			return n, err
+		}
+		family := mf.GetName()
+		m := &Meta{Type: protoTypes[mf.GetType()], Help: mf.GetHelp(), Unit: mf.GetUnit()}
+		for _, metric := range mf.GetMetric() {
+			sb.Reset()
+			for _, l := range metric.GetLabel() {
+				v := l.GetValue()
+				if strings.ContainsAny(v, "\\\"\n") {
+					v = labelEscaper.Replace(v)
+				}
+				sb.Add(l.GetName(), v)
+			}
+			sb.Sort()
+			lbls := sb.Labels()
+			add := func(name string, lbls labels.Labels, v float64) {
+				if name != lastName {
+					fn, lastName = p.aggFunc(name, m), name
+				}
+				p.add(lb, fb, name, lbls, SVal{TimestampMs: metric.GetTimestampMs(), Value: v}, family, m, fn, t, series)
+				n++
+			}
+			with := func(name, value string) labels.Labels {
+				bb.Reset(lbls)
+				bb.Set(name, value)
+				return bb.Labels()
+			}
+
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				add(family, lbls, metric.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add(family, lbls, metric.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				add(family, lbls, metric.GetUntyped().GetValue())
+			case dto.MetricType_SUMMARY:
+				s := metric.GetSummary()
+				for _, q := range s.GetQuantile() {
+					add(family, with("quantile", formatBound(q.GetQuantile())), q.GetValue())
+				}
+				add(family+"_sum", lbls, s.GetSampleSum())
+				add(family+"_count", lbls, float64(s.GetSampleCount()))
+			case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
+				h := metric.GetHistogram()
+				count := float64(h.GetSampleCount())
+				if h.GetSampleCountFloat() > 0 {
+					count = h.GetSampleCountFloat()
+				}
+				inf := false
+				for _, b := range h.GetBucket() {
+					v := float64(b.GetCumulativeCount())
+					if b.GetCumulativeCountFloat() > 0 {
+						v = b.GetCumulativeCountFloat()
+					}
+					inf = inf || math.IsInf(b.GetUpperBound(), +1)
+					add(family+"_bucket", with("le", formatBound(b.GetUpperBound())), v)
+				}
+				if !inf {
+					add(family+"_bucket", with("le", "+Inf"), count)
+				}
+				if mf.GetType() == dto.MetricType_GAUGE_HISTOGRAM {
+					add(family+"_gsum", lbls, h.GetSampleSum())
+					add(family+"_gcount", lbls, count)
+				} else {
+					add(family+"_sum", lbls, h.GetSampleSum())
+					add(family+"_count", lbls, count)
+				}
+			}
+		}
+	}
+}
+
+// renderProto writes series as delimited protobuf, histogram and summary samples are grouped back into metrics by labels
+func renderProto(series *Series, tsMs int64, w io.Writer) {
+	enc := expfmt.NewEncoder(w, expfmt.FmtProtoDelim)
+	var keys []seriaKey
+	for _, fm := range sortedFamilies(series) {
+		family, names, m := fm.name, fm.names, series.meta[fm.name]
+		if m != nil && (m.Type == "histogram" || m.Type == "gaugehistogram" || m.Type == "summary") {
+			enc.Encode(protoComplex(family, names, series, m, tsMs))
+			continue
+		}
+		for _, metricName := range names {
+			if m != nil && metricName != family && strings.HasSuffix(metricName, "_created") {
+				continue
+			}
+			mf := &dto.MetricFamily{Name: &metricName, Type: dto.MetricType_UNTYPED.Enum()}
+			if m != nil {
+				mf.Help = &m.Help
+				switch m.Type {
+				case "counter":
+					mf.Type = dto.MetricType_COUNTER.Enum()
+				case "gauge", "info", "stateset":
+					mf.Type = dto.MetricType_GAUGE.Enum()
+				}
+			}
+			keys = sortedLabels(series.data[metricName], keys)
+			for _, k := range keys {
+				value := (*series.data[metricName])[k.ls]
+				metric := &dto.Metric{Label: protoLabels(parseLabels(k.ls)), TimestampMs: protoTs(value, tsMs)}
+				switch mf.GetType() {
+				case dto.MetricType_COUNTER:
+					metric.Counter = &dto.Counter{Value: &value.Value}
+				case dto.MetricType_GAUGE:
+					metric.Gauge = &dto.Gauge{Value: &value.Value}
+				default:
+					metric.Untyped = &dto.Untyped{Value: &value.Value}
+				}
+				mf.Metric = append(mf.Metric, metric)
+			}
+			enc.Encode(mf)
+		}
+	}
+}
+
+// protoComplex groups `_bucket`, `_sum`, `_count` or quantile samples of the family into metrics with the same labels
+func protoComplex(family string, names []string, series *Series, m *Meta, tsMs int64) *dto.MetricFamily {
+	mf := &dto.MetricFamily{Name: &family, Help: &m.Help}
+	switch m.Type {
+	case "histogram":
+		mf.Type = dto.MetricType_HISTOGRAM.Enum()
+	case "gaugehistogram":
+		mf.Type = dto.MetricType_GAUGE_HISTOGRAM.Enum()
+	case "summary":
+		mf.Type = dto.MetricType_SUMMARY.Enum()
+	}
+	metrics := make(map[string]*dto.Metric) // string = Labels.String() without le/quantile
+	inf := make(map[*dto.Metric]float64)
+	lb := labels.NewBuilder(labels.EmptyLabels())
+	var keys []seriaKey
+	for _, metricName := range names {
+		suffix := strings.TrimPrefix(metricName, family)
+		keys = sortedLabels(series.data[metricName], keys)
+		for _, k := range keys {
+			value := (*series.data[metricName])[k.ls]
+			lbls := parseLabels(k.ls)
+			lb.Reset(lbls)
+			lb.Del("le", "quantile")
+			key := labelsString(lb.Labels())
+			metric := metrics[key]
+			if metric == nil {
+				metric = &dto.Metric{Label: protoLabels(lb.Labels()), TimestampMs: protoTs(value, tsMs)}
+				if m.Type == "summary" {
+					metric.Summary = &dto.Summary{}
+				} else {
+					metric.Histogram = &dto.Histogram{}
+				}
+				metrics[key] = metric
+				mf.Metric = append(mf.Metric, metric)
+			}
+			v := value.Value
+			switch {
+			case m.Type == "summary" && suffix == "":
+				q, _ := strconv.ParseFloat(lbls.Get("quantile"), 64)
+				metric.Summary.Quantile = append(metric.Summary.Quantile, &dto.Quantile{Quantile: &q, Value: &v})
+			case m.Type == "summary" && suffix == "_sum":
+				metric.Summary.SampleSum = &v
+			case m.Type == "summary" && suffix == "_count":
+				metric.Summary.SampleCount = protoCount(v)
+			case suffix == "_bucket":
+				le, _ := strconv.ParseFloat(lbls.Get("le"), 64)
+				if math.IsInf(le, +1) {
+					inf[metric] = v
+					continue
+				}
+				metric.Histogram.Bucket = append(metric.Histogram.Bucket, &dto.Bucket{UpperBound: &le, CumulativeCount: protoCount(v)})
+			case suffix == "_sum" || suffix == "_gsum":
+				metric.Histogram.SampleSum = &v
+			case suffix == "_count" || suffix == "_gcount":
+				metric.Histogram.SampleCount = protoCount(v)
+			}
+		}
+	}
+	for _, metric := range mf.Metric {
+		if h := metric.Histogram; h != nil {
+			sort.Slice(h.Bucket, func(i, j int) bool { return h.Bucket[i].GetUpperBound() < h.Bucket[j].GetUpperBound() })
+			if h.SampleCount == nil {
+				h.SampleCount = protoCount(inf[metric])
+			}
+		}
+		if s := metric.Summary; s != nil {
+			sort.Slice(s.Quantile, func(i, j int) bool { return s.Quantile[i].GetQuantile() < s.Quantile[j].GetQuantile() })
+		}
+	}
+	return mf
+}
+
+func protoLabels(ls labels.Labels) []*dto.LabelPair {
+	res := make([]*dto.LabelPair, 0, len(ls))
+	for _, l := range ls {
+		name, value := l.Name, l.Value
+		if strings.Contains(value, `\`) {
+			value = labelUnescaper.Replace(value)
+		}
+		res = append(res, &dto.LabelPair{Name: &name, Value: &value})
+	}
+	return res
+}
+
+func protoTs(value *SVal, tsMs int64) *int64 {
+	if value.TimestampMs > 0 {
+		return &value.TimestampMs
+	}
+	if tsMs > 0 {
+		return &tsMs
+	}
+	return nil
+}
+
+func protoCount(v float64) *uint64 {
+	c := uint64(v)
+	return &c
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/prometheus/model/relabel"
+)
+
+func TestProtoRoundTrip(t *testing.T) {
+	input := m(
+		`# HELP metric1 Histogram help`,
+		`# TYPE metric1 histogram`,
+		`metric1_bucket{code="200",le="0.5"} 1`,
+		`metric1_bucket{code="200",le="1"} 2`,
+		`metric1_bucket{code="200",le="+Inf"} 3`,
+		`metric1_sum{code="200"} 4.5`,
+		`metric1_count{code="200"} 3`,
+		`# TYPE metric2 summary`,
+		`metric2{quantile="0.5"} 1`,
+		`metric2{quantile="0.9"} 2`,
+		`metric2_sum 10`,
+		`metric2_count 5`,
+		`# TYPE metric3_total counter`,
+		`metric3_total{path="/a\"b\\c"} 10 1751041454000`,
+		`# TYPE metric4 untyped`,
+		`metric4 1`,
+	)
+	proxy := NewProxy(&Options{
+		Relabel: map[string][]*relabel.Config{default_subset: {}},
+	}, &slog.Logger{})
+
+	text := map[string]*Series{default_subset: NewSeries()}
+	if _, err := proxy.parse(context.Background(), strings.NewReader(input), expfmt.TypeTextPlain, nil, text); err != nil {
+		t.Fatalf("parse(%s) error = %v", input, err)
+	}
+	var b bytes.Buffer
+	render(text[default_subset], 0, expfmt.TypeProtoDelim, &b)
+
+	proto := map[string]*Series{default_subset: NewSeries()}
+	if _, err := proxy.parse(context.Background(), &b, expfmt.TypeProtoDelim, nil, proto); err != nil {
+		t.Fatalf("parseProto() error = %v", err)
+	}
+
+	want, got := sortedRender(text[default_subset]), sortedRender(proto[default_subset])
+	if got != want {
+		t.Errorf("got: '%s', want '%s'", got, want)
+	}
+}
+
+func sortedRender(s *Series) string {
+	var b strings.Builder
+	render(s, 0, expfmt.TypeTextPlain, &b)
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+func TestNormalizeBound(t *testing.T) {
+	text := m(
+		`# TYPE req_seconds histogram`,
+		`req_seconds_bucket{le="1"} 1`,
+		`req_seconds_bucket{le="+Inf"} 1`,
+		`req_seconds_sum 0.5`,
+		`req_seconds_count 1`,
+		`# TYPE rpc_seconds summary`,
+		`rpc_seconds{quantile="0.50"} 1`,
+		`rpc_seconds_sum 1`,
+		`rpc_seconds_count 1`,
+		`# TYPE size_bucket gauge`,
+		`size_bucket{le="1"} 1`,
+	)
+	proxy := NewProxy(&Options{
+		Relabel: map[string][]*relabel.Config{default_subset: {}},
+	}, slog.New(slog.DiscardHandler))
+	series := NewSeries()
+	if _, err := proxy.parse(context.Background(), strings.NewReader(text), expfmt.TypeTextPlain, nil, map[string]*Series{default_subset: series}); err != nil {
+		t.Fatal(err)
+	}
+	var proto bytes.Buffer
+	render(series, 0, expfmt.TypeProtoDelim, &proto)
+	om := m(
+		`# TYPE req_seconds histogram`,
+		`req_seconds_bucket{le="1.0"} 1`,
+		`req_seconds_bucket{le="+Inf"} 1`,
+		`req_seconds_sum 0.5`,
+		`req_seconds_count 1`,
+		`# TYPE rpc_seconds summary`,
+		`rpc_seconds{quantile="0.5"} 1`,
+		`rpc_seconds_sum 1`,
+		`rpc_seconds_count 1`,
+		`# TYPE size_bucket gauge`,
+		`size_bucket{le="1"} 1`,
+		`# EOF`,
+	)
+
+	subsets := map[string]*Series{default_subset: NewSeries()}
+	for format, input := range map[expfmt.FormatType]io.Reader{
+		expfmt.TypeTextPlain:   strings.NewReader(text),
+		expfmt.TypeOpenMetrics: strings.NewReader(om),
+		expfmt.TypeProtoDelim:  &proto,
+	} {
+		if _, err := proxy.parse(context.Background(), input, format, nil, subsets); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := m(
+		`# TYPE req_seconds histogram`,
+		`# TYPE rpc_seconds summary`,
+		`# TYPE size_bucket gauge`,
+		`req_seconds_bucket{le="+Inf"} 3`,
+		`req_seconds_bucket{le="1.0"} 3`,
+		`req_seconds_count 3`,
+		`req_seconds_sum 1.5`,
+		`rpc_seconds_count 3`,
+		`rpc_seconds_sum 3`,
+		`rpc_seconds{quantile="0.5"} 3`,
+		`size_bucket{le="1"} 1`,
+	)
+	if got := sortedRender(subsets[default_subset]); got != want {
+		t.Errorf("got: '%s', want '%s'", got, want)
+	}
+}
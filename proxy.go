@@ -2,67 +2,148 @@ package main
 
 import (
 	"bufio"
+	"cmp"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"mime"
 	"net"
 	"net/http"
-	"net/url"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/prometheus/common/expfmt"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/model/relabel"
 )
 
 // Data model for aggregation
 type Series struct {
-	data map[string]*Seria // string = MetricName
+	data map[string]*Seria  // string = MetricName
+	meta map[string]*Meta   // string = family name
+	fns  map[string]AggFunc // string = MetricName
 	mu   sync.Mutex
 }
 type Seria map[string]*SVal // string = Labels.String()
 type SVal struct {
 	TimestampMs int64 // 0 = Now
 	Value       float64
+	n           int // number of aggregated values
 }
 
 func NewSeries() *Series {
 	return &Series{
 		data: make(map[string]*Seria),
+		meta: make(map[string]*Meta),
+		fns:  make(map[string]AggFunc),
 	}
 }
-func (s *Series) Add(metricName string, ls string, value SVal) {
+func (s *Series) Add(metricName string, ls string, value SVal, fn AggFunc) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	value.n = 1
+	if fn == AggCount {
+		value.Value = 1
+	}
+	s.put(metricName, ls, value, fn)
+}
+
+// Merge aggregates other series into s, using the functions they were added with
+func (s *Series) Merge(o *Series) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for metricName, seria := range o.data {
+		for ls, value := range *seria {
+			s.put(metricName, ls, *value, o.fns[metricName])
+		}
+	}
+	for family, m := range o.meta {
+		if s.meta[family] == nil {
+			s.meta[family] = m
+		}
+	}
+}
+
+func (s *Series) put(metricName string, ls string, value SVal, fn AggFunc) {
 	if s.data[metricName] == nil {
 		tmp := make(Seria)
 		tmp[ls] = &value
 		s.data[metricName] = &tmp
+		s.fns[metricName] = fn
 	} else {
 		tmp := *s.data[metricName]
 		if tmp[ls] == nil {
 			tmp[ls] = &value
 		} else {
-			tmp[ls].Value += value.Value
+			tmp[ls].merge(value, fn)
 		}
 	}
 }
 
+// SetMeta stores metadata of the family, first one wins when upstreams disagree
+func (s *Series) SetMeta(family string, m *Meta) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.meta[family] == nil {
+		s.meta[family] = m
+	}
+}
+
+// acceptHeader prefers protobuf as the fastest to parse, then OpenMetrics as it has more metadata
+const acceptHeader = `application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited;q=0.6,application/openmetrics-text;version=1.0.0;q=0.5,application/openmetrics-text;version=0.0.1;q=0.4,text/plain;version=0.0.4;q=0.3,*/*;q=0.2`
+
 // Proxy handlers
 type Proxy struct {
-	Opts    Options
-	logger  *slog.Logger
-	subsets map[string]*Series
-	tsMs    int64
+	Opts       Options
+	logger     *slog.Logger
+	resets     map[string]*resets // string = upstream host
+	gone       map[string]*resets // counters of upstreams which are gone, string = upstream host
+	retired    map[string]*Series // last values of gone counters by subset, nil when it should be rebuilt
+	carry      map[string]*Series // last values of counters of upstreams gone for longer than goneRetention, by subset
+	observed   map[string]bool    // upstream hosts in self-metrics
+	resolver   Resolver
+	client     *http.Client // for upstreams
+	compressor *compressor
+	snapshot   atomic.Pointer[snapshot] // the last scrape result, served on subset endpoints
+	good       atomic.Pointer[snapshot] // the last successful scrape result
+	flight     *flight                  // the last scrape started by /metrics
+	flightMu   sync.Mutex
+	cache      map[string]*upstreamCache // string = upstream host
+	cacheMu    sync.Mutex
+	mu         sync.Mutex
+	cfgMu      sync.RWMutex // write locked on config reload
 }
 
 func NewProxy(opts *Options, logger *slog.Logger) *Proxy {
-	return &Proxy{Opts: *opts, logger: logger, subsets: make(map[string]*Series)}
+	p := &Proxy{
+		Opts:       *opts,
+		logger:     logger,
+		resets:     make(map[string]*resets),
+		gone:       make(map[string]*resets),
+		carry:      make(map[string]*Series),
+		cache:      make(map[string]*upstreamCache),
+		resolver:   net.DefaultResolver,
+		client:     http.DefaultClient,
+		compressor: newCompressor(opts.CompressionLevel),
+	}
+	if opts.HTTPClient != nil {
+		p.client = opts.HTTPClient
+	}
+	return p
 }
 
 // index returns help message
 func (p *Proxy) index(w http.ResponseWriter, r *http.Request) {
+	p.cfgMu.RLock()
+	defer p.cfgMu.RUnlock()
 	subsets := ""
 	for s := range p.Opts.Relabel {
 		if s != default_subset {
@@ -71,18 +152,31 @@ func (p *Proxy) index(w http.ResponseWriter, r *http.Request) {
 	}
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	w.WriteHeader(http.StatusOK)
+	admin := `
+	<a href='/analyze'>/analyze</a> - analyze upstream response for metrics and label cardinality<br/>
+	<a href='/debug/pprof/'>/debug/pprof/</a> - pprof debug endpoints<br/>`
+	if p.Opts.AdminPort != 0 {
+		admin = fmt.Sprintf("\n/analyze and /debug/pprof/ are served on port %d<br/>", p.Opts.AdminPort)
+	}
 	w.Write([]byte(`<html><body>
 	<h1>metric-gate</h1>
 	<a href='/source'>/source</a> - original metrics from upstream<br/>
-	<a href='/analyze'>/analyze</a> - analyze upstream response for metrics and label cardinality<br/>
 	<a href='/metrics'>/metrics</a> - aggregated and filtered metrics from upstream<br/>` + subsets + `
-	<a href='/debug/pprof/'>/debug/pprof/</a> - pprof debug endpoints
+	<a href='/-/metrics'>/-/metrics</a> - metrics of metric-gate itself<br/>` + admin + `
 	</body></html>`))
 }
 
-// src returns the response from upstream as is
+// src returns the response from upstream as is, compressed response is passed through when the client accepts it
 func (p *Proxy) src(w http.ResponseWriter, r *http.Request) {
-	resp, err := get(p.Opts.Upstream)
+	req, err := http.NewRequest("GET", p.upstream(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if ae := r.Header.Get("Accept-Encoding"); ae != "" {
+		req.Header.Set("Accept-Encoding", ae) // disables transparent decompression
+	}
+	resp, err := p.client.Do(req)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -94,13 +188,23 @@ func (p *Proxy) src(w http.ResponseWriter, r *http.Request) {
 			w.Header().Add(name, value)
 		}
 	}
+	encoding := ""
+	if resp.Header.Get("Content-Encoding") == "" {
+		encoding = negotiateEncoding(r.Header)
+	}
+	if encoding != "" {
+		w.Header().Del("Content-Length")
+		w.Header().Set("Content-Encoding", encoding)
+	}
 	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
+	zw := p.compressor.writer(w, encoding)
+	io.Copy(zw, resp.Body)
+	zw.Close()
 }
 
 // analyze returns metrics and label cardinality from upstream response
 func (p *Proxy) analyze(w http.ResponseWriter, r *http.Request) {
-	resp, err := get(p.Opts.Upstream)
+	resp, err := p.get(p.upstream())
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -119,178 +223,526 @@ func (p *Proxy) analyze(w http.ResponseWriter, r *http.Request) {
 
 // agg returns aggregated filtered metrics
 func (p *Proxy) agg(w http.ResponseWriter, r *http.Request) {
-	start := time.Now()
+	p.cfgMu.RLock()
+	defer p.cfgMu.RUnlock()
 	subset := r.PathValue("subset")
-	if subset != "" {
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		if p.subsets[subset] == nil {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte("No metrics had been requested by /metrics yet or no such subset defined in relabel config"))
-		} else {
-			w.WriteHeader(http.StatusOK)
-			render(p.subsets[subset], p.tsMs, w)
-		}
-		p.logger.Debug("Render subset metrics done", "took", time.Since(start))
+	format := negotiate(r.Header)
+	if p.Opts.ScrapeInterval > 0 || subset != "" {
+		p.serveSnapshot(w, r, p.snapshot.Load(), cmp.Or(subset, default_subset), format)
 		return
 	}
 
-	// reset subsets data
+	snap := p.coalesce()
+	if snap.err != nil {
+		p.serveSnapshot(w, r, snap, default_subset, format)
+		return
+	}
+	p.respond(w, r, snap.subsets[default_subset], default_subset, 0, format)
+}
+
+// collect scrapes all the targets to new series of each subset, with status series added to the default one.
+// Error is returned when targets could not be resolved or none of them could be scraped
+func (p *Proxy) collect() (map[string]*Series, error) {
 	subsets := make(map[string]*Series)
 	for s := range p.Opts.Relabel {
 		subsets[s] = NewSeries()
 	}
-	defer func() {
-		for s := range p.Opts.Relabel {
-			p.subsets[s] = subsets[s]
-		}
-	}()
 
-	hosts := []string{p.Opts.Upstream}
-	if p.Opts.Resolve != nil {
-		ips, err := net.LookupIP(p.Opts.Resolve.Hostname())
-		if err != nil {
-			p.logger.Error("Error resolving upstream", "host", p.Opts.Resolve.Host, "err", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		hosts = hosts[:0]
-		for _, ip := range ips {
-			hosts = append(hosts, ip.String())
-		}
-		p.logger.Debug("Resolved upstream", "hosts", hosts)
+	targets, err := p.targets()
+	if err != nil {
+		return subsets, err
 	}
+	hosts := make([]string, 0, len(targets))
+	for _, t := range targets {
+		hosts = append(hosts, t.Name)
+	}
+	p.logger.Debug("Resolved upstream", "hosts", hosts)
 
 	wg := sync.WaitGroup{}
-	wg.Add(len(hosts))
-	errCh := make(chan error, len(hosts))
-	for _, h := range hosts {
-		go func(host string) {
+	wg.Add(len(targets))
+	results := make([]scrapeResult, len(targets))
+	ordered := p.ordered()
+	own := make([]map[string]*Series, len(targets))
+	for i, t := range targets {
+		go func(t *Target) {
 			defer wg.Done()
-			p.scrape(host, subsets, errCh)
-		}(h)
+			dst := subsets
+			if ordered {
+				dst = make(map[string]*Series, len(subsets))
+				for s := range subsets {
+					dst[s] = NewSeries()
+				}
+				own[i] = dst
+			}
+			begin := time.Now()
+			var n int
+			var stale bool
+			var err error
+			if p.Opts.MaxStaleness > 0 {
+				n, stale, err = p.scrapeCached(t, dst)
+			} else {
+				n, err = p.scrape(t, dst)
+			}
+			results[i] = scrapeResult{host: t.Name, samples: n, duration: time.Since(begin), stale: stale, err: err}
+		}(t)
 	}
 	wg.Wait()
-	close(errCh)
-	p.logger.Debug("Upstream requests done", "took", time.Since(start), "upstreams", len(hosts), "down", len(errCh))
+	for _, o := range own { // in target order for `first` and `last` aggregations
+		for s, series := range o {
+			subsets[s].Merge(series)
+		}
+	}
+	var errs []error
+	for _, res := range results {
+		scrapeDuration.WithLabelValues(res.host).Observe(res.duration.Seconds())
+		if !res.stale {
+			scrapedSamples.Add(float64(res.samples))
+		}
+		if res.err != nil && !res.stale {
+			errs = append(errs, res.err)
+		}
+	}
+	if p.Opts.MaxStaleness > 0 {
+		p.pruneCache(hosts)
+	}
+	p.forgetUpstreams(hosts)
+	if p.Opts.ResetCompensation {
+		retired := p.retire(hosts)
+		for s := range subsets {
+			if retired[s] != nil {
+				subsets[s].Merge(retired[s])
+			}
+		}
+	}
+	for s := range subsets {
+		observeSeries(s, subsets[s])
+	}
 
-	if len(errCh) == len(hosts) {
+	if len(errs) > 0 && len(errs) == len(hosts) {
 		s := "Error getting any metrics from upstream:"
-		for e := range errCh {
+		for _, e := range errs {
 			s += "\n" + e.Error()
 		}
-		http.Error(w, s, http.StatusInternalServerError)
-		return
+		return subsets, errors.New(s)
+	}
+	if p.fanout() {
+		addUpstreamSeries(subsets[default_subset], results)
+		addSDSeries(subsets[default_subset], p.Opts.Discovery)
+	}
+	return subsets, nil
+}
+
+// respond renders series of the subset to w, compressed by Accept-Encoding of the request, observing duration and size
+func (p *Proxy) respond(w http.ResponseWriter, r *http.Request, series *Series, subset string, tsMs int64, format expfmt.Format) {
+	start := time.Now()
+	encoding := negotiateEncoding(r.Header)
+	w.Header().Set("Content-Type", string(format))
+	w.Header().Add("Vary", "Accept-Encoding")
+	if encoding != "" {
+		w.Header().Set("Content-Encoding", encoding)
 	}
-	p.tsMs = time.Now().UnixMilli()
-	start = time.Now()
-	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	w.WriteHeader(http.StatusOK)
-	render(subsets[default_subset], 0, w)
-	p.logger.Debug("Render metrics done", "took", time.Since(start))
-}
-
-// scrape fetches metrics from `host` to subsets
-func (p *Proxy) scrape(host string, subsets map[string]*Series, errCh chan error) {
-	u := host
-	if p.Opts.Resolve != nil {
-		t := url.URL{
-			Scheme:   p.Opts.Resolve.Scheme,
-			Host:     host + ":" + p.Opts.Resolve.Port(),
-			Path:     p.Opts.Resolve.Path,
-			RawQuery: p.Opts.Resolve.RawQuery,
+	cw := &countingWriter{Writer: w}
+	zw := p.compressor.writer(cw, encoding)
+	render(series, tsMs, format.FormatType(), zw)
+	zw.Close()
+	renderDuration.WithLabelValues(subset).Observe(time.Since(start).Seconds())
+	responseBytes.WithLabelValues(subset).Add(float64(cw.n))
+}
+
+// scrapeResult is the status of a single upstream request
+type scrapeResult struct {
+	host     string
+	samples  int
+	duration time.Duration
+	stale    bool // the last successful result is used
+	err      error
+}
+
+var upstreamMeta = map[string]*Meta{
+	"metric_gate_upstream_up":                      {Type: "gauge", Help: "1 if the upstream was scraped successfully, 0 otherwise"},
+	"metric_gate_upstream_scrape_duration_seconds": {Type: "gauge", Help: "Duration of the upstream scrape"},
+	"metric_gate_upstream_samples_scraped":         {Type: "gauge", Help: "Number of samples the upstream exposed"},
+	"metric_gate_upstream_stale":                   {Type: "gauge", Help: "1 if the scrape failed and the last successful result of the upstream is used"},
+}
+
+// addUpstreamSeries adds per-upstream series like Prometheus `up`, as they are lost in aggregation
+func addUpstreamSeries(series *Series, results []scrapeResult) {
+	for family, m := range upstreamMeta {
+		series.SetMeta(family, m)
+	}
+	for _, res := range results {
+		ls := fmt.Sprintf(`{upstream="%s"}`, res.host)
+		up := 1.0
+		if res.err != nil {
+			up = 0
+		}
+		series.Add("metric_gate_upstream_up", ls, SVal{Value: up}, AggMax)
+		series.Add("metric_gate_upstream_scrape_duration_seconds", ls, SVal{Value: res.duration.Seconds()}, AggMax)
+		series.Add("metric_gate_upstream_samples_scraped", ls, SVal{Value: float64(res.samples)}, AggMax)
+		stale := 0.0
+		if res.stale {
+			stale = 1
 		}
-		u = t.String()
+		series.Add("metric_gate_upstream_stale", ls, SVal{Value: stale}, AggMax)
 	}
+}
+
+// scrape fetches metrics from target `t` to subsets, returns the number of samples parsed
+func (p *Proxy) scrape(t *Target, subsets map[string]*Series) (int, error) {
+	host := t.Name
 	ctx, cancel := context.WithTimeout(context.Background(), p.Opts.Timeout)
 	defer cancel()
 
-	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", t.URL, nil)
 	if err != nil {
 		p.logger.Error("Error creating request", "host", host, "err", err)
-		errCh <- err
-		return
+		return 0, err
 	}
-	if p.Opts.Resolve != nil {
-		req.Host = p.Opts.Resolve.Hostname() // preserve the original Host header
+	if t.Host != "" {
+		req.Host = t.Host // preserve the original Host header
 	}
+	req.Header.Set("Accept", acceptHeader)
 
-	resp, err := http.DefaultClient.Do(req)
+	st := *t // targets from discovery are shared between requests
+	var ticket uint64
+	if st.resets = p.upstreamResets(t); st.resets != nil {
+		ticket = st.resets.ticket()
+		defer st.resets.done(ticket)
+	}
+	resp, err := p.client.Do(req)
 	if err != nil {
 		p.logger.Error("Request failed", "host", host, "err", err)
-		errCh <- err
-		return
+		scrapeErrors.WithLabelValues("request").Inc()
+		return 0, err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		err = fmt.Errorf("server returned HTTP status %s", resp.Status)
+		p.logger.Error("Request failed", "host", host, "err", err)
+		scrapeErrors.WithLabelValues("request").Inc()
+		return 0, err
+	}
 
-	err = p.parse(ctx, resp.Body, subsets)
+	if st.resets != nil {
+		st.resets.wait(ticket)
+		defer st.resets.mu.Unlock()
+	}
+	n, err := p.parse(ctx, resp.Body, responseFormat(resp.Header), &st, subsets)
 	if err != nil {
 		p.logger.Error("Error parsing response", "host", host, "err", err)
-		errCh <- err
-		return
+		scrapeErrors.WithLabelValues("parse").Inc()
+		return n, err
+	}
+	if ctx.Err() != nil {
+		scrapeTruncated.Inc()
+	}
+	return n, nil
+}
+
+// negotiate returns output format for the Accept header, without escaping parameters
+func negotiate(h http.Header) expfmt.Format {
+	f := expfmt.NegotiateIncludingOpenMetrics(h)
+	switch {
+	case f.FormatType() == expfmt.TypeProtoDelim:
+		return expfmt.FmtProtoDelim
+	case strings.HasPrefix(string(f), string(expfmt.FmtOpenMetrics_1_0_0)):
+		return expfmt.FmtOpenMetrics_1_0_0
+	case strings.HasPrefix(string(f), string(expfmt.FmtOpenMetrics_0_0_1)):
+		return expfmt.FmtOpenMetrics_0_0_1
 	}
+	return expfmt.FmtText
 }
 
-func get(url string) (*http.Response, error) {
+// responseFormat detects upstream format by Content-Type, defaults to textformat
+func responseFormat(h http.Header) expfmt.FormatType {
+	mediatype, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		return expfmt.TypeTextPlain
+	}
+	switch {
+	case mediatype == expfmt.OpenMetricsType:
+		return expfmt.TypeOpenMetrics
+	case mediatype == expfmt.ProtoType && params["proto"] == expfmt.ProtoProtocol && params["encoding"] == "delimited":
+		return expfmt.TypeProtoDelim
+	}
+	return expfmt.TypeTextPlain
+}
+
+func (p *Proxy) get(url string) (*http.Response, error) {
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
-	return http.DefaultClient.Do(req)
+	return p.client.Do(req)
 }
 
-// parse unpacks and filters textformat
-func (p *Proxy) parse(ctx context.Context, r io.Reader, series map[string]*Series) error {
+// parse unpacks and filters textformat or OpenMetrics, returns the number of samples parsed
+func (p *Proxy) parse(ctx context.Context, r io.Reader, format expfmt.FormatType, t *Target, series map[string]*Series) (int, error) {
+	if format == expfmt.TypeProtoDelim {
+		return p.parseProto(ctx, r, t, series)
+	}
+	om := format == expfmt.TypeOpenMetrics
 	scanner := bufio.NewScanner(r)
 	lb := labels.NewBuilder(labels.EmptyLabels())
+	fb := &familyBuffer{}
+	defer p.flush(lb, fb, t, series)
+	meta := make(map[string]*Meta) // string = family name
 	var n int
+	var lastName string
+	var fn AggFunc
 	for scanner.Scan() {
 		line := scanner.Text()
-		metricName, lbls, value, err := parseLine(line)
+		if om && line == "# EOF" {
+			break
+		}
+		metricName, lbls, value, err := parseSample(line, om)
 		if err != nil {
 			if ctx.Err() != nil {
 				p.logger.Warn("Scrape timeout reached, response truncated", "lines_parsed", n)
-				return nil
+				return n, nil
 			}
-			return err
+			return n, err
 		}
 		if metricName == "" {
+			if kind, family, text := parseComment(line); kind != "" {
+				m := meta[family]
+				if m == nil {
+					m = &Meta{}
+					meta[family] = m
+				}
+				switch kind {
+				case "HELP":
+					m.Help = text
+				case "TYPE":
+					m.Type = text
+				case "UNIT":
+					m.Unit = text
+				}
+			}
 			continue
 		}
-
-		// metric_relabel_configs
-		for subset, mrc := range p.Opts.Relabel {
-			lb.Reset(lbls)
-			lb.Set("__name__", metricName)
-			keep := relabel.ProcessBuilder(lb, mrc...)
-			if !keep {
-				continue
-			}
-			lb.Del("__name__")
-			ls := labelsString(lb.Labels())
-			series[subset].Add(metricName, ls, value)
+		family := familyName(metricName, meta)
+		if metricName != lastName {
+			fn, lastName = p.aggFunc(metricName, meta[family]), metricName
 		}
+		p.add(lb, fb, metricName, lbls, value, family, meta[family], fn, t, series)
 		n++
 	}
 	if err := scanner.Err(); err != nil && ctx.Err() != nil {
 		p.logger.Warn("Scrape timeout reached, result truncated", "lines_parsed", n)
 	}
-	return nil
+	return n, nil
+}
+
+// add applies bucket_configs, normalizes `le` and `quantile`, and applies metric_relabel_configs to the sample of target `t` and puts it to the series of each subset,
+// counter values are compensated for resets when it is enabled. Histograms and summaries are buffered to `fb` with --family-relabel
+func (p *Proxy) add(lb *labels.Builder, fb *familyBuffer, metricName string, lbls labels.Labels, value SVal, family string, m *Meta, fn AggFunc, t *Target, series map[string]*Series) {
+	if !p.keepBucket(metricName, lbls, m) {
+		return
+	}
+	lbls = normalizeBound(lb, metricName, family, lbls, m)
+	if t != nil && t.resets != nil && isCounter(metricName, family, m) {
+		value.Value = t.resets.adjust(metricName+labelsString(lbls), value.Value, family, m, fn)
+	}
+	if fb != nil && p.Opts.FamilyRelabel {
+		if fb.family != family {
+			p.flush(lb, fb, t, series)
+			fb.family, fb.m = family, m
+		}
+		if isGrouped(m) {
+			fb.push(metricName, lbls, value, fn)
+			return
+		}
+	}
+	for subset, mrc := range p.Opts.Relabel {
+		ls, keep := p.relabel(lb, metricName, lbls, family, m, t, mrc)
+		if !keep {
+			continue
+		}
+		series[subset].Add(metricName, ls, value, fn)
+		if m != nil {
+			series[subset].SetMeta(family, m)
+		}
+	}
+}
+
+// relabel applies rules to the sample of target `t`, returns the resulting label set and false if it is dropped
+func (p *Proxy) relabel(lb *labels.Builder, metricName string, lbls labels.Labels, family string, m *Meta, t *Target, mrc []*relabel.Config) (string, bool) {
+	lb.Reset(lbls)
+	if t != nil {
+		t.Labels.Range(func(l labels.Label) {
+			if !lbls.Has(l.Name) {
+				lb.Set(l.Name, l.Value)
+			}
+		})
+		t.Meta.Range(func(l labels.Label) { lb.Set(l.Name, l.Value) })
+	}
+	lb.Set("__name__", metricName)
+	if p.Opts.FamilyRelabel {
+		lb.Set("__family__", baseFamily(family, m))
+	}
+	if !relabel.ProcessBuilder(lb, mrc...) {
+		return "", false
+	}
+	lb.Del("__name__", "__family__")
+	if t != nil {
+		t.Meta.Range(func(l labels.Label) { lb.Del(l.Name) })
+	}
+	return labelsString(lb.Labels()), true
+}
+
+// render writes series in textformat, OpenMetrics or protobuf, with metadata before samples of each family
+func render(series *Series, tsMs int64, format expfmt.FormatType, w io.Writer) {
+	if format == expfmt.TypeProtoDelim {
+		renderProto(series, tsMs, w)
+		return
+	}
+	om := format == expfmt.TypeOpenMetrics
+	var keys []seriaKey
+	for _, fm := range sortedFamilies(series) {
+		family, m := fm.name, series.meta[fm.name]
+		if m != nil {
+			renderMeta(family, m, series.data, om, w)
+		}
+		for _, metricName := range fm.names {
+			if !om && m != nil && metricName != family && strings.HasSuffix(metricName, "_created") {
+				continue // textformat has no created timestamps
+			}
+			keys = sortedLabels(series.data[metricName], keys)
+			renderSeria(metricName, series.data[metricName], keys, tsMs, om, w)
+		}
+	}
+	if om {
+		w.Write([]byte("# EOF\n"))
+	}
+}
+
+// familyNames is a family with names of its metrics
+type familyNames struct {
+	name  string
+	names []string // MetricName
 }
 
-func render(series *Series, tsMs int64, w io.Writer) {
-	for metricName, seria := range series.data {
-		for labels, value := range *seria {
-			w.Write([]byte(metricName))
-			if len(labels) > 2 {
-				w.Write([]byte(labels))
+// sortedFamilies groups metric names of the series by family, both are sorted by name
+func sortedFamilies(series *Series) []familyNames {
+	names := make([]string, 0, len(series.data))
+	for metricName := range series.data {
+		names = append(names, metricName)
+	}
+	slices.Sort(names)
+	idx := make(map[string]int, len(names)) // family name = index in res
+	var res []familyNames
+	for _, metricName := range names {
+		family := familyName(metricName, series.meta)
+		i, ok := idx[family]
+		if !ok {
+			i = len(res)
+			idx[family] = i
+			res = append(res, familyNames{name: family})
+		}
+		res[i].names = append(res[i].names, metricName)
+	}
+	slices.SortFunc(res, func(a, b familyNames) int { return strings.Compare(a.name, b.name) })
+	return res
+}
+
+// seriaKey is a label set of seria, split around `le` or `quantile` label value to sort it numerically
+type seriaKey struct {
+	ls     string
+	prefix string // ls before the bound value
+	suffix string // ls after the bound value
+	bound  float64
+}
+
+// sortedLabels returns label sets of the seria sorted, with numeric order of `le` and `quantile` values, reusing buf
+func sortedLabels(seria *Seria, buf []seriaKey) []seriaKey {
+	buf = buf[:0]
+	for ls := range *seria {
+		k := seriaKey{ls: ls, prefix: ls}
+		for _, name := range []string{`le="`, `quantile="`} {
+			i := strings.Index(ls, name)
+			if i < 1 || (ls[i-1] != '{' && ls[i-1] != ',') {
+				continue
+			}
+			i += len(name)
+			j := strings.IndexByte(ls[i:], '"')
+			if j < 0 {
+				continue
+			}
+			if f, err := strconv.ParseFloat(ls[i:i+j], 64); err == nil {
+				k.prefix, k.suffix, k.bound = ls[:i], ls[i+j:], f
 			}
-			w.Write([]byte(fmt.Sprintf(" %#v", value.Value)))
-			if value.TimestampMs > 0 {
-				w.Write([]byte(fmt.Sprintf(" %d", value.TimestampMs)))
-			} else if tsMs > 0 {
-				w.Write([]byte(fmt.Sprintf(" %d", tsMs)))
+			break
+		}
+		buf = append(buf, k)
+	}
+	slices.SortFunc(buf, func(a, b seriaKey) int {
+		if c := strings.Compare(a.prefix, b.prefix); c != 0 {
+			return c
+		}
+		if c := strings.Compare(a.suffix, b.suffix); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.bound, b.bound)
+	})
+	return buf
+}
+
+// renderMeta writes HELP/TYPE/UNIT lines, converting family name and type between formats
+func renderMeta(family string, m *Meta, data map[string]*Seria, om bool, w io.Writer) {
+	name, typ := family, m.Type
+	if om {
+		switch typ {
+		case "untyped":
+			typ = "unknown"
+		case "counter":
+			name = strings.TrimSuffix(family, "_total")
+		}
+	} else {
+		switch typ {
+		case "unknown", "gaugehistogram":
+			typ = "untyped"
+		case "stateset":
+			typ = "gauge"
+		case "info":
+			typ = "gauge"
+			name = family + "_info"
+		case "counter":
+			if data[family] == nil && data[family+"_total"] != nil {
+				name = family + "_total"
 			}
-			w.Write([]byte("\n"))
 		}
 	}
+	if m.Help != "" {
+		w.Write([]byte("# HELP " + name + " " + m.Help + "\n"))
+	}
+	if typ != "" {
+		w.Write([]byte("# TYPE " + name + " " + typ + "\n"))
+	}
+	if om && m.Unit != "" {
+		w.Write([]byte("# UNIT " + name + " " + m.Unit + "\n"))
+	}
+}
+
+// renderSeria writes samples of the metric in order of `keys`
+func renderSeria(metricName string, seria *Seria, keys []seriaKey, tsMs int64, om bool, w io.Writer) {
+	for _, k := range keys {
+		labels, value := k.ls, (*seria)[k.ls]
+		w.Write([]byte(metricName))
+		if len(labels) > 2 {
+			w.Write([]byte(labels))
+		}
+		w.Write([]byte(fmt.Sprintf(" %#v", value.Value)))
+		ts := value.TimestampMs
+		if ts == 0 {
+			ts = tsMs
+		}
+		if ts > 0 && om {
+			w.Write([]byte(fmt.Sprintf(" %d.%03d", ts/1000, ts%1000))) // seconds
+		} else if ts > 0 {
+			w.Write([]byte(fmt.Sprintf(" %d", ts)))
+		}
+		w.Write([]byte("\n"))
+	}
 }
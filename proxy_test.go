@@ -2,15 +2,25 @@ package main
 
 import (
 	"context"
+	"encoding/pem"
 	"fmt"
 	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
 	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/grafana/regexp"
+	"github.com/prometheus/common/config"
+	"github.com/prometheus/common/expfmt"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/model/relabel"
+	"gopkg.in/yaml.v2"
 )
 
 func TestAgg(t *testing.T) {
@@ -76,14 +86,14 @@ func TestAgg(t *testing.T) {
 		for s := range proxy.Opts.Relabel {
 			subsets[s] = NewSeries()
 		}
-		err := proxy.parse(context.Background(), strings.NewReader(c.input), subsets)
+		_, err := proxy.parse(context.Background(), strings.NewReader(c.input), expfmt.TypeTextPlain, nil, subsets)
 		if err != nil {
 			t.Errorf("parse(%s) error = %v", c.input, err)
 		}
 
 		// default subset
 		var b strings.Builder
-		render(subsets[default_subset], 0, &b)
+		render(subsets[default_subset], 0, expfmt.TypeTextPlain, &b)
 		lines := strings.Split(strings.TrimSpace(b.String()), "\n")
 		sort.Strings(lines) // sort result
 		res := strings.Join(lines, "\n")
@@ -92,7 +102,7 @@ func TestAgg(t *testing.T) {
 		}
 
 		b.Reset()
-		render(subsets["sub"], 0, &b)
+		render(subsets["sub"], 0, expfmt.TypeTextPlain, &b)
 		lines = strings.Split(strings.TrimSpace(b.String()), "\n")
 		sort.Strings(lines) // sort result
 		res = strings.Join(lines, "\n")
@@ -102,6 +112,272 @@ func TestAgg(t *testing.T) {
 	}
 }
 
+func TestMeta(t *testing.T) {
+	input := m(
+		`# HELP metric1 Some help`,
+		`# TYPE metric1 histogram`,
+		`metric1_bucket{code="200",le="+Inf"} 1`,
+		`metric1_bucket{code="500",le="+Inf"} 2`,
+		`# HELP metric4 Dropped`,
+		`# TYPE metric4 gauge`,
+		`metric4 10`,
+	)
+	want := m(
+		`# HELP metric1 Some help`,
+		`# TYPE metric1 histogram`,
+		`metric1_bucket{le="+Inf"} 3`,
+	)
+	proxy := NewProxy(&Options{
+		Relabel: map[string][]*relabel.Config{
+			default_subset: {
+				{
+					Action: relabel.LabelDrop,
+					Regex:  relabel.Regexp{Regexp: regexp.MustCompile("code")},
+				},
+				{
+					Action:       relabel.Drop,
+					SourceLabels: model.LabelNames{"__name__"},
+					Regex:        relabel.Regexp{Regexp: regexp.MustCompile("metric4")},
+				},
+			},
+		},
+	}, &slog.Logger{})
+	subsets := map[string]*Series{default_subset: NewSeries()}
+	if _, err := proxy.parse(context.Background(), strings.NewReader(input), expfmt.TypeTextPlain, nil, subsets); err != nil {
+		t.Errorf("parse(%s) error = %v", input, err)
+	}
+	var b strings.Builder
+	render(subsets[default_subset], 0, expfmt.TypeTextPlain, &b)
+	if res := strings.TrimSpace(b.String()); res != want {
+		t.Errorf("got: '%s', want '%s'", res, want)
+	}
+}
+
+func TestRenderOrder(t *testing.T) {
+	input := m(
+		`# TYPE b_seconds histogram`,
+		`b_seconds_count{code="500"} 3`,
+		`b_seconds_bucket{code="500",le="+Inf"} 3`,
+		`b_seconds_bucket{code="500",le="10"} 2`,
+		`b_seconds_bucket{code="500",le="0.5"} 1`,
+		`b_seconds_bucket{code="500",le="1"} 1`,
+		`b_seconds_bucket{code="200",le="+Inf"} 1`,
+		`b_seconds_sum{code="500"} 7`,
+		`a_total{path="/b"} 1`,
+		`c 1`,
+		`a_total{path="/a"} 2`,
+	)
+	want := m(
+		`a_total{path="/a"} 2`,
+		`a_total{path="/b"} 1`,
+		`# TYPE b_seconds histogram`,
+		`b_seconds_bucket{code="200",le="+Inf"} 1`,
+		`b_seconds_bucket{code="500",le="0.5"} 1`,
+		`b_seconds_bucket{code="500",le="1.0"} 1`,
+		`b_seconds_bucket{code="500",le="10.0"} 2`,
+		`b_seconds_bucket{code="500",le="+Inf"} 3`,
+		`b_seconds_count{code="500"} 3`,
+		`b_seconds_sum{code="500"} 7`,
+		`c 1`,
+	)
+	proxy := NewProxy(&Options{Relabel: map[string][]*relabel.Config{default_subset: {}}}, &slog.Logger{})
+	subsets := map[string]*Series{default_subset: NewSeries()}
+	if _, err := proxy.parse(context.Background(), strings.NewReader(input), expfmt.TypeTextPlain, nil, subsets); err != nil {
+		t.Fatalf("parse(%s) error = %v", input, err)
+	}
+	for range 5 {
+		var b strings.Builder
+		render(subsets[default_subset], 0, expfmt.TypeTextPlain, &b)
+		if res := strings.TrimSpace(b.String()); res != want {
+			t.Fatalf("got: '%s', want '%s'", res, want)
+		}
+	}
+}
+
+func TestOpenMetrics(t *testing.T) {
+	cases := []struct {
+		input  string
+		format expfmt.FormatType
+		want   string
+	}{
+		{
+			input: m(
+				`# TYPE metric1 counter`,
+				`# HELP metric1 Some help`,
+				`metric1_total{code="200"} 1 # {trace_id="a"} 1`,
+				`metric1_total{code="500"} 2`,
+				`metric1_created{code="200"} 1751041454.5`,
+				`# EOF`,
+				`metric2 10`,
+			),
+			format: expfmt.TypeTextPlain,
+			want: m(
+				`# HELP metric1_total Some help`,
+				`# TYPE metric1_total counter`,
+				`metric1_total 3`,
+			),
+		},
+		{
+			input: m(
+				`# TYPE metric3_seconds gauge`,
+				`# UNIT metric3_seconds seconds`,
+				`metric3_seconds{code="200"} 1 1751041454.5`,
+				`# EOF`,
+			),
+			format: expfmt.TypeOpenMetrics,
+			want: m(
+				`# TYPE metric3_seconds gauge`,
+				`# UNIT metric3_seconds seconds`,
+				`metric3_seconds 1 1751041454.500`,
+				`# EOF`,
+			),
+		},
+	}
+	proxy := NewProxy(&Options{
+		Relabel: map[string][]*relabel.Config{
+			default_subset: {
+				{
+					Action: relabel.LabelDrop,
+					Regex:  relabel.Regexp{Regexp: regexp.MustCompile("code")},
+				},
+			},
+		},
+	}, &slog.Logger{})
+	for _, c := range cases {
+		subsets := map[string]*Series{default_subset: NewSeries()}
+		if _, err := proxy.parse(context.Background(), strings.NewReader(c.input), expfmt.TypeOpenMetrics, nil, subsets); err != nil {
+			t.Errorf("parse(%s) error = %v", c.input, err)
+		}
+		var b strings.Builder
+		render(subsets[default_subset], 0, c.format, &b)
+		if res := strings.TrimSpace(b.String()); res != c.want {
+			t.Errorf("got: '%s', want '%s'", res, c.want)
+		}
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	cases := map[string]expfmt.Format{
+		"":           expfmt.FmtText,
+		"text/plain": expfmt.FmtText,
+		"application/openmetrics-text;version=1.0.0;q=0.5,application/openmetrics-text;version=0.0.1;q=0.4,text/plain;version=0.0.4;q=0.3": expfmt.FmtOpenMetrics_1_0_0,
+		"application/openmetrics-text;version=0.0.1": expfmt.FmtOpenMetrics_0_0_1,
+	}
+	for accept, want := range cases {
+		h := http.Header{}
+		h.Set("Accept", accept)
+		if got := negotiate(h); got != want {
+			t.Errorf("negotiate(%s) got %s, want %s", accept, got, want)
+		}
+	}
+}
+
+func TestUpstreamSeries(t *testing.T) {
+	s := NewSeries()
+	addUpstreamSeries(s, []scrapeResult{
+		{host: "10.0.0.5", samples: 10, duration: 1500 * time.Millisecond},
+		{host: "10.0.0.6", err: fmt.Errorf("timeout")},
+	})
+	want := []string{
+		`# TYPE metric_gate_upstream_up gauge`,
+		`metric_gate_upstream_up{upstream="10.0.0.5"} 1`,
+		`metric_gate_upstream_up{upstream="10.0.0.6"} 0`,
+		`metric_gate_upstream_scrape_duration_seconds{upstream="10.0.0.5"} 1.5`,
+		`metric_gate_upstream_samples_scraped{upstream="10.0.0.5"} 10`,
+		`metric_gate_upstream_samples_scraped{upstream="10.0.0.6"} 0`,
+	}
+	var b strings.Builder
+	render(s, 0, expfmt.TypeTextPlain, &b)
+	lines := strings.Split(b.String(), "\n")
+	for _, w := range want {
+		if !slices.Contains(lines, w) {
+			t.Errorf("missing '%s' in '%s'", w, b.String())
+		}
+	}
+}
+
+func TestUpstreamStatus(t *testing.T) {
+	for _, body := range []string{"", "metric_total 7"} {
+		var upstreams []*UpstreamConfig
+		for _, code := range []int{http.StatusOK, http.StatusInternalServerError} {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if code != http.StatusOK {
+					w.WriteHeader(code)
+					fmt.Fprint(w, body)
+					return
+				}
+				fmt.Fprintln(w, "metric_total 5")
+			}))
+			defer srv.Close()
+			upstreams = append(upstreams, &UpstreamConfig{URL: srv.URL})
+		}
+		proxy := NewProxy(&Options{
+			Upstreams: upstreams,
+			Relabel:   map[string][]*relabel.Config{default_subset: {}},
+			Timeout:   time.Second,
+		}, slog.New(slog.DiscardHandler))
+		w := httptest.NewRecorder()
+		proxy.agg(w, httptest.NewRequest("GET", "/metrics", nil))
+		lines := strings.Split(w.Body.String(), "\n")
+		for _, want := range []string{
+			`metric_total 5`,
+			`metric_gate_upstream_up{upstream="` + strings.TrimPrefix(upstreams[1].URL, "http://") + `"} 0`,
+		} {
+			if !slices.Contains(lines, want) {
+				t.Errorf("body %q: missing '%s' in '%s'", body, want, w.Body.String())
+			}
+		}
+	}
+}
+
+func TestUpstreamHTTPConfig(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "user" || pass != "secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprintln(w, "metric1 1")
+	}))
+	defer srv.Close()
+	dir := t.TempDir()
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(filepath.Join(dir, "ca.crt"), ca, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "password"), []byte("secret"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var cfg Config
+	err := yaml.Unmarshal([]byte(`
+upstream_http_config:
+  tls_config:
+    ca_file: ca.crt
+  basic_auth:
+    username: user
+    password_file: password
+`), &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.HTTPConfig.SetDirectory(dir)
+	client, err := config.NewClientFromConfig(*cfg.HTTPConfig, "metric-gate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := NewProxy(&Options{
+		Upstreams:  []*UpstreamConfig{{URL: srv.URL}},
+		Relabel:    map[string][]*relabel.Config{default_subset: {}},
+		Timeout:    time.Second,
+		HTTPClient: client,
+	}, slog.New(slog.DiscardHandler))
+	w := httptest.NewRecorder()
+	proxy.agg(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "metric1 1") {
+		t.Errorf("got %d %s", w.Code, w.Body.String())
+	}
+}
+
 func m(parts ...string) string {
 	return strings.Join(parts, "\n")
 }
@@ -114,6 +390,6 @@ func BenchmarkRender(b *testing.B) {
 		s.data[fmt.Sprintf("nginx_ingress_controller_bytes_sent_bucket%d", i)] = &tmp
 	}
 	for b.Loop() {
-		render(s, 0, &strings.Builder{})
+		render(s, 0, expfmt.TypeTextPlain, &strings.Builder{})
 	}
 }
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"cmp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// goneRetention is how long counters state of a gone upstream is kept to be restored when it is back,
+// then its last values are folded into the relabeled carry-over, so memory is bounded by the output series
+const goneRetention = 10 * time.Minute
+
+// resets keeps the last raw values of counters from an upstream, to compensate counter resets
+type resets struct {
+	counters map[string]*counter // string = MetricName + Labels.String()
+	labels   labels.Labels       // of the target
+	meta     labels.Labels       // `__meta_*` labels of the target
+	goneAt   time.Time           // when the upstream was not resolved anymore
+	mu       sync.Mutex
+	next     uint64 // ticket of the next scrape
+	turn     uint64 // ticket of the scrape which could adjust values now
+	cond     *sync.Cond
+}
+
+// counter is the state of a counter series, with what is needed to relabel it the same way when the upstream is gone
+type counter struct {
+	last   float64
+	offset float64
+	family string
+	m      *Meta
+	fn     AggFunc
+}
+
+func newResets() *resets {
+	return &resets{
+		counters: make(map[string]*counter),
+		cond:     sync.NewCond(&sync.Mutex{}),
+	}
+}
+
+// ticket returns the order of the scrape starting now, concurrent scrapes adjust values in this order,
+// so an older result is never seen as a counter reset. done(ticket) should be called when the scrape is finished
+func (r *resets) ticket() uint64 {
+	r.cond.L.Lock()
+	defer r.cond.L.Unlock()
+	r.next++
+	return r.next - 1
+}
+
+// wait blocks until the scrapes with the previous tickets are done, and locks r
+func (r *resets) wait(ticket uint64) {
+	r.cond.L.Lock()
+	for r.turn != ticket {
+		r.cond.Wait()
+	}
+	r.cond.L.Unlock()
+	r.mu.Lock()
+}
+
+// done passes the turn to the next scrape after `ticket`
+func (r *resets) done(ticket uint64) {
+	r.cond.L.Lock()
+	defer r.cond.L.Unlock()
+	for r.turn != ticket {
+		r.cond.Wait()
+	}
+	r.turn++
+	r.cond.Broadcast()
+}
+
+// adjust returns the counter value increased by all the values it had before resets
+func (r *resets) adjust(key string, v float64, family string, m *Meta, fn AggFunc) float64 {
+	c := r.counters[key]
+	if c == nil {
+		c = &counter{}
+		r.counters[key] = c
+	} else if v < c.last {
+		c.offset += c.last
+	}
+	c.last, c.family, c.m, c.fn = v, family, m, fn
+	return v + c.offset
+}
+
+// isCounter is true for samples which could only grow until reset
+func isCounter(metricName, family string, m *Meta) bool {
+	if m == nil {
+		return false
+	}
+	switch m.Type {
+	case "counter":
+		return metricName == family || !strings.HasSuffix(metricName, "_created")
+	case "histogram":
+		return metricName != family+"_created"
+	case "summary":
+		return metricName == family+"_sum" || metricName == family+"_count"
+	}
+	return false
+}
+
+// upstreamResets returns counters state of the target, or nil when compensation is disabled.
+// State of the upstream which was gone and is back is restored, so its counters continue from the retired values
+func (p *Proxy) upstreamResets(t *Target) *resets {
+	if !p.Opts.ResetCompensation {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.resets[t.Name] == nil {
+		p.resets[t.Name] = p.gone[t.Name]
+		if p.resets[t.Name] != nil {
+			delete(p.gone, t.Name)
+			p.retired = nil
+			p.logger.Debug("Upstream is back, its counters are restored", "host", t.Name)
+		} else {
+			p.resets[t.Name] = newResets()
+		}
+	}
+	p.resets[t.Name].labels, p.resets[t.Name].meta = t.Labels, t.Meta
+	return p.resets[t.Name]
+}
+
+// retire moves counters state of upstreams which are not in `hosts` to p.gone, and those which are back to p.resets.
+// State of upstreams gone for longer than goneRetention is folded into p.carry.
+// Returns the last values of gone counters by subset, so that they are still added to the result and
+// the aggregated counters do not decrease
+func (p *Proxy) retire(hosts []string) map[string]*Series {
+	alive := make(map[string]bool, len(hosts))
+	for _, h := range hosts {
+		alive[h] = true
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	for host, rs := range p.resets {
+		if !alive[host] {
+			rs.goneAt = now
+			p.gone[host] = rs
+			delete(p.resets, host)
+			p.retired = nil
+			p.logger.Debug("Upstream is gone, its counters are retired", "host", host)
+		}
+	}
+	for host := range alive {
+		if rs := p.gone[host]; rs != nil {
+			p.resets[host] = rs
+			delete(p.gone, host)
+			p.retired = nil
+		}
+	}
+	for host, rs := range p.gone {
+		if now.Sub(rs.goneAt) < goneRetention {
+			continue
+		}
+		for s := range p.Opts.Relabel {
+			if p.carry[s] == nil {
+				p.carry[s] = NewSeries()
+			}
+		}
+		p.replay(rs, p.carry)
+		delete(p.gone, host)
+		p.retired = nil
+		p.logger.Debug("Upstream is gone for long, its counters are folded", "host", host)
+	}
+	if p.retired != nil {
+		return p.retired
+	}
+	p.retired = make(map[string]*Series, len(p.Opts.Relabel))
+	for s := range p.Opts.Relabel {
+		p.retired[s] = NewSeries()
+		if p.carry[s] != nil {
+			p.retired[s].Merge(p.carry[s])
+		}
+	}
+	for _, rs := range p.gone {
+		p.replay(rs, p.retired)
+	}
+	return p.retired
+}
+
+// replay adds the last values of counters in `rs` to series, relabeled as they were by the scrapes of the upstream
+func (p *Proxy) replay(rs *resets, series map[string]*Series) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	keys := make([]string, 0, len(rs.counters))
+	for key := range rs.counters {
+		keys = append(keys, key)
+	}
+	// samples of a family should be in a row for --family-relabel
+	slices.SortFunc(keys, func(a, b string) int {
+		return cmp.Or(strings.Compare(rs.counters[a].family, rs.counters[b].family), strings.Compare(a, b))
+	})
+	t := &Target{Labels: rs.labels, Meta: rs.meta}
+	lb := labels.NewBuilder(labels.EmptyLabels())
+	fb := &familyBuffer{}
+	for _, key := range keys {
+		metricName, lbls, _, err := parseLine(key + " 0")
+		if err != nil {
+			continue
+		}
+		c := rs.counters[key]
+		p.add(lb, fb, metricName, lbls, SVal{Value: c.last + c.offset}, c.family, c.m, c.fn, t, series)
+	}
+	p.flush(lb, fb, t, series)
+}
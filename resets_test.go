@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/relabel"
+)
+
+func TestResetCompensation(t *testing.T) {
+	rounds := []struct {
+		upstreams map[string]string
+		want      string
+	}{
+		{upstreams: map[string]string{"a": "10", "b": "20"}, want: "metric_total 30"},
+		{upstreams: map[string]string{"a": "10", "b": "0"}, want: "metric_total 30"},
+		{upstreams: map[string]string{"a": "10", "b": "5"}, want: "metric_total 35"},
+		{upstreams: map[string]string{"a": "10"}, want: "metric_total 35"},
+		{upstreams: map[string]string{"a": "12", "c": "1"}, want: "metric_total 38"},
+		{upstreams: map[string]string{"a": "12", "b": "5", "c": "1"}, want: "metric_total 38"}, // b is back
+		{upstreams: map[string]string{"a": "12", "b": "0", "c": "1"}, want: "metric_total 38"},
+	}
+	proxy := NewProxy(&Options{
+		Relabel:           map[string][]*relabel.Config{default_subset: {}},
+		ResetCompensation: true,
+	}, slog.New(slog.DiscardHandler))
+	for i, r := range rounds {
+		subsets := map[string]*Series{default_subset: NewSeries()}
+		hosts := []string{}
+		for host, v := range r.upstreams {
+			input := m(`# TYPE metric_total counter`, `metric_total `+v)
+			if _, err := proxy.parse(context.Background(), strings.NewReader(input), expfmt.TypeTextPlain, &Target{Name: host, resets: proxy.upstreamResets(&Target{Name: host})}, subsets); err != nil {
+				t.Errorf("parse(%s) error = %v", input, err)
+			}
+			hosts = append(hosts, host)
+		}
+		subsets[default_subset].Merge(proxy.retire(hosts)[default_subset])
+
+		var b strings.Builder
+		render(subsets[default_subset], 0, expfmt.TypeTextPlain, &b)
+		lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+		if res := lines[len(lines)-1]; res != r.want {
+			t.Errorf("round %d got: '%s', want '%s'", i, res, r.want)
+		}
+	}
+}
+
+func TestResetsCarryOver(t *testing.T) {
+	proxy := NewProxy(&Options{
+		Relabel:           map[string][]*relabel.Config{default_subset: {}},
+		ResetCompensation: true,
+	}, slog.New(slog.DiscardHandler))
+	scrape := func(hosts ...string) string {
+		t.Helper()
+		subsets := map[string]*Series{default_subset: NewSeries()}
+		for _, host := range hosts {
+			input := m(`# TYPE metric_total counter`, `metric_total 10`)
+			if _, err := proxy.parse(context.Background(), strings.NewReader(input), expfmt.TypeTextPlain, &Target{Name: host, resets: proxy.upstreamResets(&Target{Name: host})}, subsets); err != nil {
+				t.Fatal(err)
+			}
+		}
+		subsets[default_subset].Merge(proxy.retire(hosts)[default_subset])
+		var b strings.Builder
+		render(subsets[default_subset], 0, expfmt.TypeTextPlain, &b)
+		lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+		return lines[len(lines)-1]
+	}
+	scrape("a", "b", "c")
+	scrape("a")
+	if len(proxy.gone) != 2 {
+		t.Fatalf("got %d gone upstreams, want 2", len(proxy.gone))
+	}
+
+	// state of upstreams gone for long is freed, but their values are still added
+	proxy.gone["b"].goneAt = time.Now().Add(-goneRetention)
+	proxy.gone["c"].goneAt = time.Now().Add(-goneRetention)
+	if res := scrape("a"); res != "metric_total 30" {
+		t.Errorf("got: '%s', want 'metric_total 30'", res)
+	}
+	if len(proxy.gone) != 0 {
+		t.Errorf("got %d gone upstreams, want 0", len(proxy.gone))
+	}
+	if res := scrape("a"); res != "metric_total 30" {
+		t.Errorf("got: '%s', want 'metric_total 30'", res)
+	}
+}
+
+func TestResetsFamilyRelabel(t *testing.T) {
+	cfg, err := parseRelabel([]byte(`
+aggregation_configs:
+- regex: peak_total
+  function: max
+metric_relabel_configs:
+- source_labels: [__family__]
+  regex: req_seconds|peak
+  action: keep
+- source_labels: [__meta_zone]
+  target_label: zone
+- action: labeldrop
+  regex: pod
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := NewProxy(&Options{
+		Relabel:           cfg.relabel(),
+		Aggregation:       cfg.Aggregation,
+		FamilyRelabel:     true,
+		ResetCompensation: true,
+	}, slog.New(slog.DiscardHandler))
+	want := []string{
+		`peak_total{zone="z"} 7`,
+		`req_seconds_bucket{le="+Inf",zone="z"} 10`,
+		`req_seconds_count{zone="z"} 10`,
+		`req_seconds_sum{zone="z"} 4`,
+	}
+	for i, hosts := range [][]string{{"a", "b"}, {"a"}} {
+		subsets := map[string]*Series{default_subset: NewSeries()}
+		for _, host := range hosts {
+			peak := map[string]string{"a": "3", "b": "7"}[host]
+			input := m(
+				`# TYPE req_seconds histogram`,
+				`req_seconds_bucket{pod="`+host+`",le="+Inf"} 5`,
+				`req_seconds_sum{pod="`+host+`"} 2`,
+				`req_seconds_count{pod="`+host+`"} 5`,
+				`# TYPE peak_total counter`,
+				`peak_total{pod="`+host+`"} `+peak,
+			)
+			target := &Target{Name: host, Meta: labels.FromStrings("__meta_zone", "z")}
+			st := *target
+			st.resets = proxy.upstreamResets(target)
+			if _, err := proxy.parse(context.Background(), strings.NewReader(input), expfmt.TypeTextPlain, &st, subsets); err != nil {
+				t.Fatal(err)
+			}
+		}
+		subsets[default_subset].Merge(proxy.retire(hosts)[default_subset])
+
+		var b strings.Builder
+		render(subsets[default_subset], 0, expfmt.TypeTextPlain, &b)
+		lines := strings.Split(b.String(), "\n")
+		for _, w := range want {
+			if !slices.Contains(lines, w) {
+				t.Errorf("round %d: missing '%s' in:\n%s", i, w, b.String())
+			}
+		}
+	}
+}
+
+func TestResetsSharedTargets(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "# TYPE metric_total counter")
+		fmt.Fprintln(w, "metric_total 1")
+	}))
+	defer srv.Close()
+	d := &sdState{logger: slog.New(slog.DiscardHandler)}
+	d.set([]*Target{{URL: srv.URL, Name: "a"}})
+	proxy := NewProxy(&Options{
+		Relabel:           map[string][]*relabel.Config{default_subset: {}},
+		Discovery:         []Discoverer{d},
+		Timeout:           time.Second,
+		ResetCompensation: true,
+	}, slog.New(slog.DiscardHandler))
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			proxy.agg(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics", nil))
+		}()
+	}
+	wg.Wait()
+	if d.Targets()[0].resets != nil {
+		t.Error("shared target is modified by scrape")
+	}
+}
+
+func TestResetsOrder(t *testing.T) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v := 20
+		if hits.Add(1) == 1 {
+			time.Sleep(200 * time.Millisecond) // the first scrape finishes last
+			v = 10
+		}
+		fmt.Fprintln(w, "# TYPE metric_total counter")
+		fmt.Fprintf(w, "metric_total %d\n", v)
+	}))
+	defer srv.Close()
+	proxy := NewProxy(&Options{
+		Relabel:           map[string][]*relabel.Config{default_subset: {}},
+		Timeout:           time.Second,
+		ResetCompensation: true,
+	}, slog.New(slog.DiscardHandler))
+	target := &Target{URL: srv.URL, Name: "a"}
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			proxy.scrape(target, map[string]*Series{default_subset: NewSeries()})
+		}()
+		time.Sleep(50 * time.Millisecond)
+	}
+	wg.Wait()
+	if c := proxy.resets["a"].counters["metric_total{}"]; c.offset != 0 {
+		t.Errorf("older result is seen as counter reset: %v", c.offset)
+	}
+}
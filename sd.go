@@ -0,0 +1,234 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/discovery/targetgroup"
+	"github.com/prometheus/prometheus/model/labels"
+	"gopkg.in/yaml.v2"
+)
+
+// Discoverer provides the current list of targets
+type Discoverer interface {
+	Targets() []*Target
+	Health() sdHealth
+}
+
+// sdHealth is the state of service discovery, exposed as metrics
+type sdHealth struct {
+	Name        string // path or URL
+	Targets     int
+	Failures    int
+	LastSuccess time.Time
+}
+
+// sdState keeps the last good targets of a Discoverer
+type sdState struct {
+	logger  *slog.Logger
+	targets []*Target
+	health  sdHealth
+	mu      sync.RWMutex
+}
+
+func (d *sdState) Targets() []*Target {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.targets
+}
+
+func (d *sdState) Health() sdHealth {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.health
+}
+
+// set replaces the targets
+func (d *sdState) set(targets []*Target) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.targets = targets
+	d.health.Targets = len(targets)
+}
+
+// run calls `refresh` every `interval`, previous targets are kept on errors
+func (d *sdState) run(ctx context.Context, interval time.Duration, refresh func() error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			d.check(refresh())
+		}
+	}
+}
+
+// check updates health by the result of refresh
+func (d *sdState) check(err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err == nil {
+		d.health.LastSuccess = time.Now()
+		return
+	}
+	d.health.Failures++
+	d.logger.Error("Error refreshing service discovery, using previous targets", "sd", d.health.Name, "err", err)
+}
+
+// groupTargets converts target groups to targets, taking scheme and path from
+// `__scheme__` and `__metrics_path__` labels as Prometheus does, `__meta_*` labels are kept for relabeling.
+// Entries with empty `__address__` are skipped
+func groupTargets(groups []*targetgroup.Group) []*Target {
+	var res []*Target
+	for _, g := range groups {
+		for _, t := range g.Targets {
+			ls := g.Labels.Merge(t)
+			address := string(ls[model.AddressLabel])
+			if address == "" {
+				continue
+			}
+			scheme := cmp.Or(string(ls[model.SchemeLabel]), "http")
+			path := cmp.Or(string(ls[model.MetricsPathLabel]), "/metrics")
+			b := labels.NewBuilder(labels.EmptyLabels())
+			meta := labels.NewBuilder(labels.EmptyLabels())
+			for k, v := range ls {
+				switch {
+				case !k.IsValid():
+				case strings.HasPrefix(string(k), model.MetaLabelPrefix):
+					meta.Set(string(k), string(v))
+				case !strings.HasPrefix(string(k), model.ReservedLabelPrefix):
+					b.Set(string(k), string(v))
+				}
+			}
+			res = append(res, &Target{URL: scheme + "://" + address + path, Name: address, Labels: b.Labels(), Meta: meta.Labels()})
+		}
+	}
+	return res
+}
+
+// fileSD reads targets from a file in Prometheus file_sd_config format, and re-reads it on changes
+type fileSD struct {
+	sdState
+	path    string
+	modTime time.Time
+}
+
+// newFileSD reads the file, which should be valid on start
+func newFileSD(path string, logger *slog.Logger) (*fileSD, error) {
+	d := &fileSD{sdState: sdState{logger: logger, health: sdHealth{Name: path}}, path: path}
+	err := d.refresh()
+	d.check(err)
+	return d, err
+}
+
+// refresh re-reads the file when it is modified
+func (d *fileSD) refresh() error {
+	fi, err := os.Stat(d.path) // follows symlinks, as in k8s configMap
+	if err != nil {
+		return err
+	}
+	if fi.ModTime().Equal(d.modTime) {
+		return nil
+	}
+	data, err := os.ReadFile(d.path)
+	if err != nil {
+		return err
+	}
+	var groups []*targetgroup.Group
+	switch filepath.Ext(d.path) {
+	case ".json":
+		err = json.Unmarshal(data, &groups)
+	case ".yml", ".yaml":
+		err = yaml.UnmarshalStrict(data, &groups)
+	default:
+		err = fmt.Errorf("unknown file extension, should be one of .json, .yml, .yaml")
+	}
+	if err != nil {
+		return err
+	}
+
+	d.modTime = fi.ModTime()
+	d.set(groupTargets(groups))
+	d.logger.Debug("Loaded upstream-sd-file", "file", d.path, "targets", len(d.Targets()))
+	return nil
+}
+
+// httpSD polls an endpoint in Prometheus http_sd_config format
+type httpSD struct {
+	sdState
+	url    string
+	client *http.Client
+}
+
+// newHTTPSD makes the first request, errors are logged as the endpoint could be unavailable on start
+func newHTTPSD(url string, timeout time.Duration, logger *slog.Logger) *httpSD {
+	d := &httpSD{sdState: sdState{logger: logger, health: sdHealth{Name: url}}, url: url, client: &http.Client{Timeout: timeout}}
+	d.check(d.refresh())
+	return d
+}
+
+func (d *httpSD) refresh() error {
+	req, err := http.NewRequest("GET", d.url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("server returned HTTP status %s", resp.Status)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		return fmt.Errorf("unsupported content type %q", ct)
+	}
+	var groups []*targetgroup.Group
+	if err := json.NewDecoder(resp.Body).Decode(&groups); err != nil {
+		return err
+	}
+
+	d.set(groupTargets(groups))
+	d.logger.Debug("Loaded upstream-sd-url", "url", d.url, "targets", len(d.Targets()))
+	return nil
+}
+
+var sdMeta = map[string]*Meta{
+	"metric_gate_sd_targets":                        {Type: "gauge", Help: "Number of targets from the service discovery"},
+	"metric_gate_sd_refresh_failures_total":         {Type: "counter", Help: "Number of failed service discovery refreshes"},
+	"metric_gate_sd_last_success_timestamp_seconds": {Type: "gauge", Help: "Time of the last successful service discovery refresh"},
+}
+
+// addSDSeries adds health series of service discoveries
+func addSDSeries(series *Series, ds []Discoverer) {
+	if len(ds) == 0 {
+		return
+	}
+	for family, m := range sdMeta {
+		series.SetMeta(family, m)
+	}
+	for _, d := range ds {
+		h := d.Health()
+		ls := fmt.Sprintf(`{sd="%s"}`, labelEscaper.Replace(h.Name))
+		var last float64
+		if !h.LastSuccess.IsZero() {
+			last = float64(h.LastSuccess.UnixMilli()) / 1000
+		}
+		series.Add("metric_gate_sd_targets", ls, SVal{Value: float64(h.Targets)}, AggMax)
+		series.Add("metric_gate_sd_refresh_failures_total", ls, SVal{Value: float64(h.Failures)}, AggMax)
+		series.Add("metric_gate_sd_last_success_timestamp_seconds", ls, SVal{Value: last}, AggMax)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/expfmt"
+)
+
+func TestFileSD(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "targets.yml")
+	write := func(data string, mtime time.Time) {
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	write(`
+- targets: [10.0.0.1:8080, '', 10.0.0.2:8080]
+  labels:
+    cluster: a
+    __metrics_path__: /stats
+- targets: [10.0.0.3:9090]
+  labels:
+    __scheme__: https
+`, now.Add(-time.Minute))
+
+	d, err := newFileSD(path, slog.New(slog.DiscardHandler))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		`http://10.0.0.1:8080/stats 10.0.0.1:8080 {cluster="a"}`,
+		`http://10.0.0.2:8080/stats 10.0.0.2:8080 {cluster="a"}`,
+		`https://10.0.0.3:9090/metrics 10.0.0.3:9090 {}`,
+	}
+	check := func() {
+		t.Helper()
+		ts := d.Targets()
+		if len(ts) != len(want) {
+			t.Fatalf("got %d targets, want %d", len(ts), len(want))
+		}
+		for i, tg := range ts {
+			if got := tg.URL + " " + tg.Name + " " + tg.Labels.String(); got != want[i] {
+				t.Errorf("got %s, want %s", got, want[i])
+			}
+		}
+	}
+	check()
+
+	// invalid file keeps previous targets
+	write(`- targets: [`, now)
+	if err := d.refresh(); err == nil {
+		t.Error("expected error for invalid file")
+	}
+	check()
+
+	write(`[{"targets": ["10.0.0.4:8080"]}]`, now.Add(time.Minute))
+	if err := d.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{`http://10.0.0.4:8080/metrics 10.0.0.4:8080 {}`}
+	check()
+}
+
+func TestHTTPSD(t *testing.T) {
+	fail := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `[{"targets": ["10.0.0.1:8080", "", "10.0.0.2:8080"], "labels": {"dc": "x"}}]`)
+	}))
+	defer srv.Close()
+
+	d := newHTTPSD(srv.URL, time.Second, slog.New(slog.DiscardHandler))
+	if ts := d.Targets(); len(ts) != 2 || ts[1].URL != "http://10.0.0.2:8080/metrics" || ts[1].Labels.Get("dc") != "x" {
+		t.Fatalf("unexpected targets %v", ts)
+	}
+
+	// last good targets are kept on failure
+	fail = true
+	d.check(d.refresh())
+	if ts := d.Targets(); len(ts) != 2 {
+		t.Errorf("got %d targets, want 2", len(ts))
+	}
+	h := d.Health()
+	if h.Failures != 1 || h.Targets != 2 || h.LastSuccess.IsZero() {
+		t.Errorf("unexpected health %+v", h)
+	}
+
+	series := NewSeries()
+	addSDSeries(series, []Discoverer{d})
+	w := &strings.Builder{}
+	render(series, 0, expfmt.TypeTextPlain, w)
+	for _, want := range []string{
+		"# TYPE metric_gate_sd_refresh_failures_total counter",
+		fmt.Sprintf(`metric_gate_sd_refresh_failures_total{sd="%s"} 1`, srv.URL),
+		fmt.Sprintf(`metric_gate_sd_targets{sd="%s"} 2`, srv.URL),
+	} {
+		if !strings.Contains(w.String(), want) {
+			t.Errorf("missing %q in:\n%s", want, w.String())
+		}
+	}
+}
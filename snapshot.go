@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/common/expfmt"
+)
+
+// snapshot is the result of a scrape of all the upstreams, published atomically for all the subsets
+type snapshot struct {
+	subsets map[string]*Series
+	tsMs    int64 // time of the scrape, added to samples without timestamp
+	err     error
+}
+
+// scrapeLoop scrapes upstreams every `interval` with jitter, and publishes the result for all the subsets at once
+func (p *Proxy) scrapeLoop(ctx context.Context, interval time.Duration) {
+	for {
+		p.cfgMu.RLock()
+		if snap := p.refresh(); snap.err != nil {
+			p.logger.Error("Background scrape failed", "err", snap.err)
+		}
+		p.cfgMu.RUnlock()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(jitter(interval)):
+		}
+	}
+}
+
+// refresh collects upstreams and publishes the result, should be called with cfgMu read locked
+func (p *Proxy) refresh() *snapshot {
+	subsets, err := p.collect()
+	snap := &snapshot{subsets: subsets, tsMs: time.Now().UnixMilli(), err: err}
+	p.snapshot.Store(snap)
+	if err == nil {
+		p.good.Store(snap)
+	}
+	return snap
+}
+
+// flight is a scrape of upstreams shared by concurrent /metrics requests
+type flight struct {
+	start time.Time
+	done  chan struct{}
+	snap  *snapshot
+}
+
+// coalesce refreshes the snapshot, or waits for the result of the scrape started less than --scrape-coalesce-window ago
+func (p *Proxy) coalesce() *snapshot {
+	p.flightMu.Lock()
+	f := p.flight
+	if f != nil && time.Since(f.start) < p.Opts.CoalesceWindow {
+		p.flightMu.Unlock()
+		<-f.done
+		coalescedRequests.Inc()
+		return f.snap
+	}
+	f = &flight{start: time.Now(), done: make(chan struct{})}
+	p.flight = f
+	p.flightMu.Unlock()
+	f.snap = p.refresh()
+	close(f.done)
+	return f.snap
+}
+
+// jitter returns `interval` randomly changed by up to 10%, so multiple instances do not scrape upstreams in sync
+func jitter(interval time.Duration) time.Duration {
+	spread := int64(interval / 5)
+	return interval - interval/10 + time.Duration(rand.Int64N(spread+1))
+}
+
+// serveSnapshot responds with the subset from `snap`, samples have its timestamp. When the scrape failed,
+// the last successful one is served instead within --serve-stale-for. Should be called with cfgMu read locked
+func (p *Proxy) serveSnapshot(w http.ResponseWriter, r *http.Request, snap *snapshot, subset string, format expfmt.Format) {
+	if snap != nil && snap.err != nil {
+		if good := p.lastGood(); good != nil {
+			p.logger.Warn("Serving the last successful scrape", "subset", subset, "age", age(good.tsMs), "err", snap.err)
+			w.Header().Set("Warning", `110 - "Response is Stale"`)
+			staleResponses.WithLabelValues(subset).Inc()
+			snap = good
+		}
+	}
+	switch {
+	case snap == nil && p.Opts.ScrapeInterval > 0:
+		http.Error(w, "No upstream scrape has finished yet", http.StatusServiceUnavailable)
+	case snap == nil:
+		http.Error(w, "No metrics had been requested by /metrics yet", http.StatusBadRequest)
+	case snap.err != nil:
+		http.Error(w, snap.err.Error(), http.StatusInternalServerError)
+	case snap.subsets[subset] == nil || p.Opts.Relabel[subset] == nil:
+		http.Error(w, "No such subset defined in relabel config", http.StatusBadRequest)
+	default:
+		w.Header().Set("Age", age(snap.tsMs))
+		p.respond(w, r, snap.subsets[subset], subset, snap.tsMs, format)
+	}
+}
+
+// lastGood returns the last successful scrape result, unless it is older than --serve-stale-for
+func (p *Proxy) lastGood() *snapshot {
+	good := p.good.Load()
+	if good == nil || time.Since(time.UnixMilli(good.tsMs)) >= p.Opts.ServeStaleFor {
+		return nil
+	}
+	return good
+}
+
+// age returns seconds passed since `tsMs`, for the Age header
+func age(tsMs int64) string {
+	return strconv.FormatInt(max(time.Now().UnixMilli()-tsMs, 0)/1000, 10)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/grafana/regexp"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/relabel"
+)
+
+func TestScrapeLoop(t *testing.T) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		fmt.Fprintln(w, `metric1{pod="a"} 1`)
+		fmt.Fprintln(w, `metric2{pod="a"} 2`)
+	}))
+	defer srv.Close()
+	proxy := NewProxy(&Options{
+		Upstreams: []*UpstreamConfig{{URL: srv.URL}},
+		Relabel: map[string][]*relabel.Config{
+			default_subset: {},
+			"sub": {{
+				Action:       relabel.Keep,
+				SourceLabels: model.LabelNames{"__name__"},
+				Regex:        relabel.Regexp{Regexp: regexp.MustCompile("metric2")},
+			}},
+		},
+		Timeout:        time.Second,
+		ScrapeInterval: time.Hour,
+	}, slog.New(slog.DiscardHandler))
+	get := func(subset string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/metrics/"+subset, nil)
+		req.SetPathValue("subset", subset)
+		proxy.agg(w, req)
+		return w
+	}
+	if w := get(""); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("got %d before the first scrape", w.Code)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go proxy.scrapeLoop(ctx, time.Hour)
+	for i := 0; proxy.snapshot.Load() == nil; i++ {
+		if i > 100 {
+			t.Fatal("no snapshot published")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	tsMs := proxy.snapshot.Load().tsMs
+	cases := []struct {
+		subset string
+		want   string
+	}{
+		{"", fmt.Sprintf(`metric1{pod="a"} 1 %d`, tsMs)},
+		{"sub", fmt.Sprintf(`metric2{pod="a"} 2 %d`, tsMs)},
+	}
+	for _, c := range cases {
+		w := get(c.subset)
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), c.want) {
+			t.Errorf("subset %q: got %d, missing %q in:\n%s", c.subset, w.Code, c.want, w.Body.String())
+		}
+		if w.Header().Get("Age") == "" {
+			t.Errorf("subset %q: no Age header", c.subset)
+		}
+	}
+	if w := get("unknown"); w.Code != http.StatusBadRequest {
+		t.Errorf("got %d for unknown subset", w.Code)
+	}
+	if n := hits.Load(); n != 1 {
+		t.Errorf("got %d upstream requests, want 1", n)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	for range 100 {
+		if d := jitter(time.Minute); d < 54*time.Second || d > 66*time.Second {
+			t.Errorf("jitter(1m) = %s", d)
+		}
+	}
+}
+
+func TestCoalesce(t *testing.T) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		time.Sleep(100 * time.Millisecond)
+		fmt.Fprintln(w, `metric1{pod="a"} 1`)
+	}))
+	defer srv.Close()
+	for _, c := range []struct {
+		window time.Duration
+		want   int32
+	}{
+		{0, 5},
+		{time.Minute, 1},
+	} {
+		hits.Store(0)
+		proxy := NewProxy(&Options{
+			Upstreams:      []*UpstreamConfig{{URL: srv.URL}},
+			Relabel:        map[string][]*relabel.Config{default_subset: {}, "sub": {}},
+			Timeout:        time.Second,
+			CoalesceWindow: c.window,
+		}, slog.New(slog.DiscardHandler))
+		var wg sync.WaitGroup
+		for range 5 {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				w := httptest.NewRecorder()
+				proxy.agg(w, httptest.NewRequest("GET", "/metrics", nil))
+				if !strings.Contains(w.Body.String(), `metric1{pod="a"} 1`) {
+					t.Errorf("window %s: unexpected response %d:\n%s", c.window, w.Code, w.Body.String())
+				}
+			}()
+			go func() {
+				defer wg.Done()
+				req := httptest.NewRequest("GET", "/metrics/sub", nil)
+				req.SetPathValue("subset", "sub")
+				proxy.agg(httptest.NewRecorder(), req)
+			}()
+		}
+		wg.Wait()
+		if n := hits.Load(); n != c.want {
+			t.Errorf("window %s: got %d upstream requests, want %d", c.window, n, c.want)
+		}
+	}
+}
+
+func TestServeStale(t *testing.T) {
+	var failing atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable) // empty body parses fine
+			return
+		}
+		fmt.Fprintln(w, `metric1{pod="a"} 1`)
+	}))
+	defer srv.Close()
+	proxy := NewProxy(&Options{
+		Upstreams:     []*UpstreamConfig{{URL: srv.URL}},
+		Relabel:       map[string][]*relabel.Config{default_subset: {}},
+		Timeout:       time.Second,
+		ServeStaleFor: time.Minute,
+	}, slog.New(slog.DiscardHandler))
+	get := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		proxy.agg(w, httptest.NewRequest("GET", "/metrics", nil))
+		return w
+	}
+	if w := get(); w.Code != http.StatusOK || w.Header().Get("Warning") != "" {
+		t.Fatalf("got %d %q:\n%s", w.Code, w.Header().Get("Warning"), w.Body.String())
+	}
+
+	failing.Store(true)
+	want := fmt.Sprintf(`metric1{pod="a"} 1 %d`, proxy.good.Load().tsMs)
+	w := get()
+	if w.Code != http.StatusOK || w.Header().Get("Warning") == "" || !strings.Contains(w.Body.String(), want) {
+		t.Errorf("got %d %q, want stale %q in:\n%s", w.Code, w.Header().Get("Warning"), want, w.Body.String())
+	}
+
+	// too old
+	proxy.good.Load().tsMs -= time.Hour.Milliseconds()
+	if w := get(); w.Code != http.StatusInternalServerError {
+		t.Errorf("got %d for expired stale result", w.Code)
+	}
+}